@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"time"
+
+	"criticalsys.net/hashcalcmt/hasher"
+)
+
+// defaultBenchmarkSize is the size of the buffer hashed by --benchmark, large enough for the
+// setup of each algorithm to be negligible.
+const defaultBenchmarkSize = "256MiB"
+
+// runBenchmark hashes a buffer of pseudo-random bytes of the given size in memory with each
+// hash type, and writes the throughput of each to w in decimal megabytes per second. No file
+// is read, so the figures are the CPU cost of the algorithms on this machine, the upper bound
+// of what the storage can be hashed at with a single worker.
+func runBenchmark(ctx context.Context, w io.Writer, hashTypes []string, size int64) error {
+	buf := make([]byte, size)
+	_, _ = rand.NewChaCha8([32]byte{}).Read(buf) // #nosec G104 -- ChaCha8 reads never fail
+
+	width := 0
+	for _, hashType := range hashTypes {
+		width = max(width, len(hashType))
+	}
+	fmt.Fprintf(w, "Hashing %s in memory with each algorithm\n", formatBytes(size))
+	for _, hashType := range hashTypes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hf, err := hasher.GetHasher(hashType)
+		if err != nil {
+			return err
+		}
+		begin := time.Now()
+		if _, err := hf(bytes.NewReader(buf)); err != nil {
+			return fmt.Errorf("%s: %w", hashType, err)
+		}
+		throughput := 0.0
+		if seconds := time.Since(begin).Seconds(); seconds > 0 {
+			throughput = float64(size) / 1e6 / seconds
+		}
+		fmt.Fprintf(w, "%-*s %10.1f MB/s\n", width, hashType, throughput)
+	}
+	return nil
+}
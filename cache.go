@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"criticalsys.net/hashcalcmt/hasher"
+	"criticalsys.net/hashcalcmt/pipeline"
+)
+
+// cacheEntry is a line of the --cache file: the digests of a file, keyed by algorithm name
+// such as "SHA256" or "HMAC-SHA256", along with the encoding, truncation and BLAKE3 length of
+// the digests, the fingerprint of their key, and the size and modification time the file had
+// when they were computed.
+type cacheEntry struct {
+	Path      string            `json:"path"`
+	Size      int64             `json:"size"`
+	ModTime   time.Time         `json:"mtime"`
+	Encoding  string            `json:"encoding"`
+	Truncate  int               `json:"truncate,omitempty"`
+	Blake3Len int               `json:"blake3_length,omitempty"`
+	KeyID     string            `json:"key_id,omitempty"`
+	Hashes    map[string]string `json:"hashes"`
+}
+
+// hashCache holds the entries of the --cache file written by a previous run, and collects
+// the entries of the current run that replace them once it completes.
+type hashCache struct {
+	cfg      *Config
+	keyID    string
+	previous map[string]cacheEntry
+	current  []cacheEntry
+}
+
+// loadCache reads a cache file, one JSON entry per line. A missing file is an empty cache,
+// so that the first run creates it.
+func loadCache(name string, cfg *Config) (cache *hashCache, err error) {
+	cache = &hashCache{cfg: cfg, keyID: cacheKeyID(cfg), previous: make(map[string]cacheEntry)}
+	file, err := os.Open(filepath.Clean(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(file))
+	for {
+		var entry cacheEntry
+		if err := dec.Decode(&entry); errors.Is(err, io.EOF) {
+			return cache, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		cache.previous[filepath.FromSlash(entry.Path)] = entry
+	}
+}
+
+// reuse returns the cached digests of a file whose size and modification time are unchanged,
+// provided the cache holds every requested algorithm in the configured encoding, truncation
+// and BLAKE3 length, computed with the same key. Hex digests are returned in the case selected
+// by --uppercase. Only the previous entries are read, so
+// reuse is safe for concurrent use by the workers.
+func (c *hashCache) reuse(rel string, size int64, modTime time.Time) (map[string]string, bool) {
+	entry, ok := c.previous[rel]
+	if !ok || entry.Size != size || !entry.ModTime.Equal(modTime) || entry.Encoding != c.cfg.Encoding || entry.Truncate != c.cfg.Truncate || entry.Blake3Len != c.cfg.blake3Length() || entry.KeyID != c.keyID {
+		return nil, false
+	}
+	hashes := make(map[string]string, len(c.cfg.HashTypes))
+	for _, hashType := range c.cfg.HashTypes {
+		digest, ok := entry.Hashes[c.cfg.algorithm(hashType)]
+		if !ok {
+			return nil, false
+		}
+		if c.cfg.Encoding == hasher.EncodingHex {
+			if c.cfg.Uppercase {
+				digest = strings.ToUpper(digest)
+			} else {
+				digest = strings.ToLower(digest)
+			}
+		}
+		hashes[hashType] = digest
+	}
+	return hashes, true
+}
+
+// cacheKeyID returns the fingerprint of the keys of the digests, recorded in the cache entries
+// so that changing a key invalidates them: the hex SHA-256 of the HMAC key, the BLAKE3 key and
+// the BLAKE3 derivation context, each prefixed with its length, or an empty string when the
+// digests are not keyed. The keys themselves are never written to the cache.
+func cacheKeyID(cfg *Config) string {
+	if cfg.hmacKey == nil && cfg.blake3Key == nil && cfg.Blake3Ctx == "" {
+		return ""
+	}
+	h := sha256.New()
+	for _, key := range [][]byte{cfg.hmacKey, cfg.blake3Key, []byte(cfg.Blake3Ctx)} {
+		h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(key))))
+		h.Write(key)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// add records the digests of a file, computed or reused, for the updated cache.
+func (c *hashCache) add(result pipeline.Result) {
+	hashes := make(map[string]string, len(result.Hashes))
+	for hashType, digest := range result.Hashes {
+		hashes[c.cfg.algorithm(hashType)] = digest
+	}
+	c.current = append(c.current, cacheEntry{
+		Path:      filepath.ToSlash(result.FilePath),
+		Size:      result.Size,
+		ModTime:   result.ModTime,
+		Encoding:  c.cfg.Encoding,
+		Truncate:  c.cfg.Truncate,
+		Blake3Len: c.cfg.blake3Length(),
+		KeyID:     c.keyID,
+		Hashes:    hashes,
+	})
+}
+
+// save replaces the cache file with the entries of the current run and the previous entries
+// of the files it did not hash, such as those left out by the filters, sorted by path. When
+// the run walked the whole tree, with root as the directory of --path, the previous entries
+// of the files that no longer exist under root are dropped; otherwise root is empty and they
+// are all kept, as the run may have missed files that still exist. The cache is replaced
+// atomically, which leaves the previous cache intact if writing fails.
+func (c *hashCache) save(name, root string) error {
+	entries := c.current
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		seen[entry.Path] = true
+	}
+	for _, entry := range c.previous {
+		if seen[entry.Path] {
+			continue
+		}
+		if root != "" {
+			if _, err := os.Lstat(filepath.Join(root, filepath.FromSlash(entry.Path))); errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+
+	file, err := createAtomic(filepath.Clean(name))
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(file)
+	enc := json.NewEncoder(bw)
+	for _, entry := range entries {
+		if err = enc.Encode(entry); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Commit()
+}
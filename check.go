@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"criticalsys.net/hashcalcmt/hasher"
+	"criticalsys.net/hashcalcmt/pipeline"
+)
+
+// Verification statuses reported by the --check mode.
+const (
+	statusOK      = "OK"
+	statusFailed  = "FAILED"
+	statusMissing = "MISSING"
+)
+
+// manifestEntry is a single file and its expected hash read from a manifest. Algorithm is the
+// name of the digest given by a "path (TYPE): hash" line, as written with several hash types,
+// and is empty for the lines that do not name it.
+type manifestEntry struct {
+	Path      string
+	Hash      string
+	Algorithm string
+}
+
+// coreutilsLine matches "<hash>  <path>" and "<hash> *<path>" lines, optionally
+// prefixed with a backslash when the file name is escaped.
+var coreutilsLine = regexp.MustCompile(`^(\\?)([0-9a-fA-F]+) [ *](.+)$`)
+
+// bsdLine matches "TYPE (path) = hash" lines, optionally prefixed with a backslash when the
+// file name is escaped.
+var bsdLine = regexp.MustCompile(`^(\\?)([\w-]+) \((.+)\) = ([0-9a-fA-F]+)$`)
+
+// coreutilsUnescaper reverses the file name escaping applied by formatCoreutilsLine.
+var coreutilsUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r")
+
+// runCheck verifies the files listed in a manifest against their recorded hashes.
+// Each entry is reported as OK, FAILED or MISSING on stdout; OK entries are omitted with --quiet.
+// A file listed with several algorithms is read once, computing all of them, and each of its
+// entries is reported as "path (TYPE): STATUS" so that the mismatching algorithm is known.
+// The entries that do not name their algorithm are verified with the first hash type.
+// It returns false if any entry did not verify successfully.
+func runCheck(ctx context.Context, cfg *Config, hf hasher.MultiFunc) (bool, error) {
+	entries, err := readManifest(cfg.Check)
+	if err != nil {
+		return false, err
+	}
+
+	computed := make(map[string]string, len(cfg.HashTypes))
+	for _, hashType := range cfg.HashTypes {
+		computed[strings.ToUpper(cfg.algorithm(hashType))] = hashType
+	}
+	hashTypes := make([]string, len(entries))
+	for i, entry := range entries {
+		hashTypes[i] = cfg.HashTypes[0]
+		if entry.Algorithm != "" {
+			hashType, ok := computed[strings.ToUpper(entry.Algorithm)]
+			if !ok {
+				return false, fmt.Errorf("the manifest lists %s digests, which are not computed with the selected --hash", entry.Algorithm)
+			}
+			hashTypes[i] = hashType
+		}
+	}
+
+	// Absolute paths, as written with --path-style=absolute, are resolved relative to the root.
+	files := make([]string, 0, len(entries))
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if file := relativeTo(cfg.absRoot, entry.Path); !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+
+	// Every entry is verified: --max-files would report the entries past it as failed.
+	opts := cfg.pipelineOptions()
+	opts.MaxFiles = 0
+	actual := make(map[string]pipeline.Result, len(files))
+	for result := range pipeline.RunFiles(ctx, opts, files, hf) {
+		if result.FilePath == "" && result.Error != nil {
+			return false, result.Error
+		}
+		actual[result.FilePath] = result
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	var failed, missing int
+	for i, entry := range entries {
+		result := actual[relativeTo(cfg.absRoot, entry.Path)]
+		status := statusOK
+		switch {
+		case errors.Is(result.Error, fs.ErrNotExist):
+			status = statusMissing
+			missing++
+		case result.Error != nil:
+			status = statusFailed
+			failed++
+			logError(slog.LevelError, &fileError{Op: "checking", Path: entry.Path, Err: result.Error})
+		case cfg.EmptyAs != "" && entry.Hash == cfg.EmptyAs:
+			if result.Size != 0 {
+				status = statusFailed
+				failed++
+			}
+		case !sameDigest(result.Hashes[hashTypes[i]], entry.Hash, cfg.Encoding):
+			status = statusFailed
+			failed++
+		}
+		if status != statusOK || !cfg.Quiet {
+			if entry.Algorithm != "" {
+				fmt.Printf("%s (%s): %s\n", entry.Path, entry.Algorithm, status)
+			} else {
+				fmt.Printf("%s: %s\n", entry.Path, status)
+			}
+		}
+	}
+
+	if failed > 0 {
+		logger.Warn(fmt.Sprintf("%d of %d listed entries did NOT match", failed, len(entries)), "failed", failed, "listed", len(entries))
+	}
+	if missing > 0 {
+		logger.Warn(fmt.Sprintf("%d of %d listed entries are missing", missing, len(entries)), "missing", missing, "listed", len(entries))
+	}
+	return failed == 0 && missing == 0, nil
+}
+
+// readManifest parses a manifest written in the text ("path: hash") or
+// coreutils ("<hash>  <path>") format. Blank lines and "#" comments are ignored.
+func readManifest(filename string) (entries []manifestEntry, err error) {
+	file, err := os.Open(filepath.Clean(filename))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry, ok := parseManifestLine(line)
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: malformed manifest line", filename, lineNo)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// parseManifestLine parses a single coreutils, BSD or text manifest line. The algorithm of a
+// "TYPE (path) = hash" or "path (TYPE): hash" line is only recognized when TYPE names a
+// supported hash type, so that other file names with parentheses are read as is.
+func parseManifestLine(line string) (manifestEntry, bool) {
+	if m := bsdLine.FindStringSubmatch(line); m != nil {
+		if _, _, _, err := digestHashType(m[2]); err == nil {
+			name := m[3]
+			if m[1] != "" {
+				name = coreutilsUnescaper.Replace(name)
+			}
+			return manifestEntry{Path: filepath.FromSlash(name), Hash: m[4], Algorithm: m[2]}, true
+		}
+	}
+	if m := coreutilsLine.FindStringSubmatch(line); m != nil {
+		name := m[3]
+		if m[1] != "" {
+			name = coreutilsUnescaper.Replace(name)
+		}
+		return manifestEntry{Path: filepath.FromSlash(name), Hash: m[2]}, true
+	}
+	i := strings.LastIndex(line, ": ")
+	if i <= 0 {
+		return manifestEntry{}, false
+	}
+	entry := manifestEntry{Path: line[:i], Hash: line[i+2:]}
+	if j := strings.LastIndex(entry.Path, " ("); j > 0 && strings.HasSuffix(entry.Path, ")") {
+		algorithm := entry.Path[j+2 : len(entry.Path)-1]
+		if _, _, _, err := digestHashType(algorithm); err == nil {
+			entry.Path, entry.Algorithm = entry.Path[:j], algorithm
+		}
+	}
+	return entry, true
+}
+
+// digestKeyFlags maps the prefixes of the digests computed with a key, as named in the output,
+// to the flag providing the key.
+var digestKeyFlags = map[string]string{"HMAC-": "hmac-key", "KEYED-": "blake3-key", "DERIVED-": "blake3-derive-context"}
+
+// digestHashType returns the hash type of a digest named as in the output, such as "SHA256",
+// "HMAC-SHA256", "KEYED-BLAKE3" or "FINGERPRINT-SHA256", the flag providing its key if it is
+// keyed, and whether it is a metadata fingerprint.
+func digestHashType(algorithm string) (hashType, keyFlag string, fingerprint bool, err error) {
+	hashType, fingerprint = strings.CutPrefix(algorithm, "FINGERPRINT-")
+	for prefix, name := range digestKeyFlags {
+		if rest, ok := strings.CutPrefix(hashType, prefix); ok {
+			hashType, keyFlag = rest, name
+			break
+		}
+	}
+	hashType, err = hasher.CanonicalType(hashType)
+	return hashType, keyFlag, fingerprint, err
+}
+
+// sameDigest compares two encoded digests. Hex and base32 are case-insensitive,
+// while base64 digests must match exactly.
+func sameDigest(a, b, encoding string) bool {
+	switch encoding {
+	case hasher.EncodingBase64, hasher.EncodingBase64URL:
+		return a == b
+	default:
+		return strings.EqualFold(a, b)
+	}
+}
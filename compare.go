@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"criticalsys.net/hashcalcmt/hasher"
+	"criticalsys.net/hashcalcmt/pipeline"
+)
+
+// Comparison statuses reported by the --compare mode, relative to the tree of --path.
+const (
+	statusAdded   = "ADDED"
+	statusRemoved = "REMOVED"
+	statusChanged = "CHANGED"
+)
+
+// treeDiff lists the relative paths of the files that differ between two trees, by status.
+type treeDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+// empty reports whether the trees hold the same files with the same contents.
+func (d treeDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// runCompare hashes the files of --path and of the --compare directory, selected by the same
+// options, and reports the differences by relative path: files only found in the compared
+// directory are added, files only found under --path are removed, and files whose digests
+// differ for any of the requested hash types are changed. Files that could not be hashed
+// are reported on stderr. It returns false if the trees differ or a file could not be hashed.
+func runCompare(ctx context.Context, cfg *Config, hf hasher.MultiFunc) (bool, error) {
+	base, baseFailed, err := hashTree(ctx, cfg, cfg.Path, hf)
+	if err != nil {
+		return false, err
+	}
+	other, otherFailed, err := hashTree(ctx, cfg, cfg.Compare, hf)
+	if err != nil {
+		return false, err
+	}
+
+	diff := treeDiff{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	for filePath, hashes := range base {
+		otherHashes, ok := other[filePath]
+		switch {
+		case !ok:
+			diff.Removed = append(diff.Removed, filePath)
+		case !maps.Equal(hashes, otherHashes):
+			diff.Changed = append(diff.Changed, filePath)
+		}
+	}
+	for filePath := range other {
+		if _, ok := base[filePath]; !ok {
+			diff.Added = append(diff.Added, filePath)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+
+	if err := writeDiff(os.Stdout, diff, cfg); err != nil {
+		return false, err
+	}
+	if !diff.empty() {
+		logger.Warn(fmt.Sprintf("%d added, %d removed, %d changed", len(diff.Added), len(diff.Removed), len(diff.Changed)), "added", len(diff.Added), "removed", len(diff.Removed), "changed", len(diff.Changed))
+	}
+	return diff.empty() && baseFailed == 0 && otherFailed == 0, nil
+}
+
+// hashTree hashes the files of the tree rooted at root with the selection options of cfg and
+// returns their digests by relative path, along with the number of files that failed.
+// Failing to open or walk the root is returned as an error.
+func hashTree(ctx context.Context, cfg *Config, root string, hf hasher.MultiFunc) (map[string]map[string]string, int, error) {
+	// Both trees are hashed in full: --max-files would report the files past it as added or removed.
+	opts := cfg.pipelineOptions()
+	opts.Path, opts.MaxFiles = root, 0
+	hashes := make(map[string]map[string]string)
+	failed := 0
+	for result := range pipeline.Run(ctx, opts, hf) {
+		switch {
+		case result.Error != nil && result.FilePath == "":
+			return nil, 0, result.Error
+		case result.Error != nil:
+			logError(slog.LevelError, &fileError{Op: "comparing", Path: filepath.Join(root, result.FilePath), Err: result.Error})
+			failed++
+		default:
+			hashes[result.FilePath] = result.Hashes
+		}
+	}
+	return hashes, failed, ctx.Err()
+}
+
+// writeDiff renders the differences to w, as a JSON object with the json format, one
+// {"path", "status"} object per line with the ndjson format, or otherwise as "<path>: <status>"
+// lines grouped by status.
+func writeDiff(w io.Writer, diff treeDiff, cfg *Config) error {
+	if cfg.Format == formatJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diff)
+	}
+	groups := []struct {
+		status string
+		paths  []string
+	}{
+		{statusAdded, diff.Added},
+		{statusRemoved, diff.Removed},
+		{statusChanged, diff.Changed},
+	}
+	enc := json.NewEncoder(w)
+	for _, group := range groups {
+		for _, filePath := range group.paths {
+			var err error
+			if cfg.Format == formatNDJSON {
+				err = enc.Encode(struct {
+					Path   string `json:"path"`
+					Status string `json:"status"`
+				}{filePath, group.status})
+			} else {
+				_, err = fmt.Fprintf(w, "%s: %s\n", filePath, group.status)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix prefixes the environment variables setting the flags, as in HASHCALCMT_WORKERS.
+const envPrefix = "HASHCALCMT_"
+
+// envName returns the environment variable setting a flag: its name in uppercase with the
+// dashes replaced by underscores, after envPrefix.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnvironment sets the flags that were not given on the command line from their
+// environment variable, as named by envName, when it is set. It is applied before the config
+// file, so that the precedence is defaults < config file < environment < command line.
+func applyEnvironment() error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if err != nil || given[f.Name] || !ok {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%s: %w", envName(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+// applyConfigFile sets the flags that were not given on the command line from a --config
+// file, a YAML or JSON mapping of flag names to values, such as:
+//
+//	hash: SHA256
+//	exclude: [.git, node_modules]
+//	workers: auto
+//
+// Lists are joined with commas, as accepted by the flags taking several values. The flags
+// set by the environment or the command line take precedence, as described by applyEnvironment.
+func applyConfigFile(name string) error {
+	data, err := os.ReadFile(filepath.Clean(name))
+	if err != nil {
+		return err
+	}
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "config" || flag.Lookup(key) == nil {
+			return fmt.Errorf("%s: unknown option %q", name, key)
+		}
+		if given[key] {
+			continue
+		}
+		value, err := configValue(values[key])
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", name, key, err)
+		}
+		if err := flag.Set(key, value); err != nil {
+			return fmt.Errorf("%s: %s: %w", name, key, err)
+		}
+	}
+	return nil
+}
+
+// configValue returns a value of the config file as the flag argument it stands for.
+func configValue(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		return "", fmt.Errorf("expected a value or a list, not a mapping")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
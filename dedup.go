@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"criticalsys.net/hashcalcmt/pipeline"
+)
+
+// duplicateGroup is a set of files sharing the same digest, and so the same size in bytes.
+type duplicateGroup struct {
+	Hash      string   `json:"hash"`
+	Algorithm string   `json:"algorithm"`
+	Size      int64    `json:"size"`
+	Paths     []string `json:"paths"`
+}
+
+// findDuplicates groups the files by their digest of the first requested hash type and returns
+// the groups of two or more files, largest first. Paths are sorted within each group.
+func findDuplicates(results map[string]pipeline.Result, cfg *Config) []duplicateGroup {
+	hashType := cfg.HashTypes[0]
+	byHash := make(map[string][]string)
+	sizes := make(map[string]int64)
+	for filePath, result := range results {
+		digest := result.Hashes[hashType]
+		byHash[digest] = append(byHash[digest], cfg.outputPath(filePath))
+		sizes[digest] = result.Size
+	}
+
+	groups := []duplicateGroup{}
+	for digest, paths := range byHash {
+		if len(paths) < 2 {
+			continue
+		}
+		sort.Strings(paths)
+		groups = append(groups, duplicateGroup{Hash: digest, Algorithm: cfg.algorithm(hashType), Size: sizes[digest], Paths: paths})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if len(groups[i].Paths) != len(groups[j].Paths) {
+			return len(groups[i].Paths) > len(groups[j].Paths)
+		}
+		return groups[i].Hash < groups[j].Hash
+	})
+	return groups
+}
+
+// writeDuplicates renders the duplicate groups to w, as a JSON array with the json format,
+// one JSON object per line with the ndjson format, or otherwise as a "<hash> (<n> files)"
+// header followed by the indented paths of each group.
+func writeDuplicates(w io.Writer, groups []duplicateGroup, cfg *Config) error {
+	switch cfg.Format {
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(groups)
+	case formatNDJSON:
+		enc := json.NewEncoder(w)
+		for _, group := range groups {
+			if err := enc.Encode(group); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i, group := range groups {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s (%d files)\n", group.Hash, len(group.Paths)); err != nil {
+			return err
+		}
+		for _, filePath := range group.Paths {
+			if _, err := fmt.Fprintf(w, "  %s\n", filePath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readFileList reads the --files-from list, one path per line, from a file or from standard
+// input when name is "-". Blank lines and repeated paths are ignored, and trailing carriage
+// returns removed. With nul, as for --files-from0, the paths are separated by NUL bytes
+// instead and kept verbatim, so that they may contain newlines or trailing spaces.
+// Relative paths are relative to root, and absolute paths are made relative to it; a path
+// outside of root is kept as is so that hashing it reports the error. URLs are kept verbatim.
+func readFileList(name, root string, nul bool) (files []string, err error) {
+	var r io.Reader = os.Stdin
+	if name != stdinPath {
+		file, err := os.Open(filepath.Clean(name))
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			closeErr := file.Close()
+			if err == nil {
+				err = closeErr
+			}
+		}()
+		r = file
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	if nul {
+		scanner.Split(scanNUL)
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !nul {
+			line = strings.TrimRight(line, "\r")
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+		} else if line == "" {
+			continue
+		}
+		rel := line
+		if !isURL(line) {
+			rel = relativeTo(absRoot, line)
+		}
+		if !seen[rel] {
+			seen[rel] = true
+			files = append(files, rel)
+		}
+	}
+	return files, scanner.Err()
+}
+
+// scanNUL is a bufio.SplitFunc returning the NUL-terminated entries of the input, as written
+// by find -print0 or git -z. The last entry may omit its terminator.
+func scanNUL(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// relativeTo returns a listed path relative to the absolute root directory.
+func relativeTo(absRoot, path string) string {
+	path = filepath.Clean(path)
+	if !filepath.IsAbs(path) {
+		return path
+	}
+	if rel, err := filepath.Rel(absRoot, path); err == nil {
+		return rel
+	}
+	return path
+}
@@ -0,0 +1,127 @@
+package hasher
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"sync"
+)
+
+// minCRCChunk is the smallest part of an input hashed on its own by the FuncAt of a CRC, below
+// which splitting the input costs more than it saves.
+const minCRCChunk = 4 << 20
+
+// crcPoly is the reversed polynomial and the width in bits of a CRC hash type.
+type crcPoly struct {
+	poly  uint64
+	width int
+}
+
+// crcPolys lists the CRC hash types, whose digests GetHasherAt computes in parallel parts.
+var crcPolys = map[string]crcPoly{
+	HashCRC32:    {crc32.IEEE, 32},
+	HashCRC32C:   {crc32.Castagnoli, 32},
+	HashCRC64:    {crc64.ECMA, 64},
+	HashCRC64ISO: {crc64.ISO, 64},
+}
+
+// at returns a FuncAt splitting its input into at most parts parts of at least minChunk
+// bytes, hashing them concurrently with newHasher and combining their CRCs into the CRC of the
+// whole input, which is the same as the streaming digest.
+func (c crcPoly) at(newHasher func() hash.Hash, parts int, minChunk int64) FuncAt {
+	return func(r io.ReaderAt, size int64) (string, error) {
+		n := max(min(int64(parts), size/minChunk), 1)
+		chunk := (size + n - 1) / n
+		sums := make([]uint64, n)
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := range n {
+			wg.Go(func() {
+				off := i * chunk
+				length := max(min(chunk, size-off), 0)
+				h := newHasher()
+				if copied, err := io.Copy(h, io.NewSectionReader(r, off, length)); err != nil {
+					errs[i] = err
+				} else if copied != length {
+					errs[i] = io.ErrUnexpectedEOF
+				}
+				sums[i] = beUint64(h.Sum(nil))
+			})
+		}
+		wg.Wait()
+		if err := errors.Join(errs...); err != nil {
+			return "", err
+		}
+		crc := sums[0]
+		for i := int64(1); i < n; i++ {
+			crc = c.combine(crc, sums[i], max(min(chunk, size-i*chunk), 0))
+		}
+		digest := binary.BigEndian.AppendUint64(nil, crc)
+		return hex.EncodeToString(digest[8-c.width/8:]), nil
+	}
+}
+
+// beUint64 returns the big-endian digest of a CRC as an integer.
+func beUint64(digest []byte) uint64 {
+	var v uint64
+	for _, b := range digest {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// combine returns the CRC of the concatenation of two inputs from their CRCs and the length of
+// the second one, as zlib's crc32_combine does: the first CRC is shifted through len2 zero
+// bytes by squaring the matrix of the shift of one zero bit over GF(2).
+func (c crcPoly) combine(crc1, crc2 uint64, len2 int64) uint64 {
+	if len2 <= 0 {
+		return crc1
+	}
+	even := make([]uint64, c.width)
+	odd := make([]uint64, c.width)
+	odd[0] = c.poly
+	for n := 1; n < c.width; n++ {
+		odd[n] = 1 << (n - 1)
+	}
+	gf2Square(even, odd) // two zero bits
+	gf2Square(odd, even) // four zero bits
+	for {
+		gf2Square(even, odd) // the first time, one zero byte
+		if len2&1 != 0 {
+			crc1 = gf2Times(even, crc1)
+		}
+		if len2 >>= 1; len2 == 0 {
+			break
+		}
+		gf2Square(odd, even)
+		if len2&1 != 0 {
+			crc1 = gf2Times(odd, crc1)
+		}
+		if len2 >>= 1; len2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
+
+// gf2Times multiplies the vector vec by the matrix mat over GF(2).
+func gf2Times(mat []uint64, vec uint64) uint64 {
+	var sum uint64
+	for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+	}
+	return sum
+}
+
+// gf2Square sets square to the square of the matrix mat over GF(2).
+func gf2Square(square, mat []uint64) {
+	for n := range mat {
+		square[n] = gf2Times(mat, mat[n])
+	}
+}
@@ -0,0 +1,39 @@
+package hasher
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// Encoding names accepted by GetEncoding.
+const (
+	// EncodingHex is lowercase hexadecimal, the conventional representation of digests.
+	EncodingHex = "hex"
+	// EncodingBase64 is standard base64 with padding (RFC 4648).
+	EncodingBase64 = "base64"
+	// EncodingBase64URL is unpadded URL and file name safe base64 (RFC 4648 section 5).
+	EncodingBase64URL = "base64url"
+	// EncodingBase32 is standard base32 with padding (RFC 4648).
+	EncodingBase32 = "base32"
+)
+
+// Encoding renders a raw digest as a string.
+type Encoding func(digest []byte) string
+
+// GetEncoding returns the Encoding matching the requested name.
+func GetEncoding(name string) (Encoding, error) {
+	switch name {
+	case EncodingHex:
+		return hex.EncodeToString, nil
+	case EncodingBase64:
+		return base64.StdEncoding.EncodeToString, nil
+	case EncodingBase64URL:
+		return base64.RawURLEncoding.EncodeToString, nil
+	case EncodingBase32:
+		return base32.StdEncoding.EncodeToString, nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %s", name)
+	}
+}
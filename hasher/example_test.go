@@ -0,0 +1,33 @@
+package hasher_test
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"criticalsys.net/hashcalcmt/hasher"
+)
+
+func ExampleHashPath() {
+	dir, err := os.MkdirTemp("", "hasher")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "release.txt")
+	if err := os.WriteFile(path, []byte("abc"), 0o600); err != nil {
+		log.Fatal(err)
+	}
+
+	hf, err := hasher.GetHasher(hasher.HashSHA256)
+	if err != nil {
+		log.Fatal(err)
+	}
+	digest, err := hasher.HashPath(path, hf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(digest)
+	// Output: ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad
+}
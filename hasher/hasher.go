@@ -1,22 +1,35 @@
 // Package hasher provides a unified interface for various hashing algorithms.
-// It supports standard cryptographic hashes (MD5, SHA1, SHA256) and
-// high-performance non-cryptographic hashes (XXH3, HighwayHash, Wyhash, Blake3)
+// It supports standard cryptographic hashes (MD5, SHA1, SHA-2, SHA-3, BLAKE2, Blake3) and
+// high-performance non-cryptographic hashes and checksums (CRC32, CRC64, XXH3, HighwayHash, Wyhash)
 // specifically optimized for file integrity verification.
 package hasher
 
 import (
+	"crypto/hmac"
 	"crypto/md5"  // #nosec G501 -- MD5 is supported as a legacy hash option for file integrity verification, not for security-critical contexts.
 	"crypto/sha1" // #nosec G505 -- SHA1 is supported as a legacy hash option for file integrity verification, not for security-critical contexts.
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
+	"hash/crc32"
+	"hash/crc64"
 	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
 
 	"github.com/minio/highwayhash"
 	"github.com/orisano/wyhash"
 	"github.com/zeebo/blake3"
 	"github.com/zeebo/xxh3"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/sha3"
 )
 
 // Hash types constants define the supported hashing algorithms.
@@ -27,77 +40,473 @@ const (
 	HashSHA1 = "SHA1"
 	// HashSHA256 is the standard SHA-256 algorithm (256-bit).
 	HashSHA256 = "SHA256"
+	// HashSHA384 is the SHA-384 algorithm (384-bit), a truncated SHA-512 variant.
+	HashSHA384 = "SHA384"
+	// HashSHA512 is the SHA-512 algorithm (512-bit).
+	HashSHA512 = "SHA512"
+	// HashSHA3_256 is the SHA3-256 algorithm (256-bit) from the Keccak-based SHA-3 family.
+	HashSHA3_256 = "SHA3-256"
+	// HashSHA3_512 is the SHA3-512 algorithm (512-bit) from the Keccak-based SHA-3 family.
+	HashSHA3_512 = "SHA3-512"
+	// HashCRC32 is the IEEE CRC-32 checksum (32-bit), as used by zip, gzip and PNG.
+	HashCRC32 = "CRC32"
+	// HashCRC32C is the Castagnoli CRC-32 checksum (32-bit), hardware accelerated on modern CPUs.
+	HashCRC32C = "CRC32C"
+	// HashCRC64 is the ECMA-182 CRC-64 checksum (64-bit), as used by xz and tape archives.
+	HashCRC64 = "CRC64"
+	// HashCRC64ISO is the ISO 3309 CRC-64 checksum (64-bit), kept for legacy files.
+	HashCRC64ISO = "CRC64-ISO"
+	// HashXXH3_64 is the 64-bit version of XXH3, the fastest option on modern CPUs.
+	HashXXH3_64 = "XXH3"
 	// HashXXH3 is the 128-bit version of XXH3, optimized for high performance.
 	HashXXH3 = "XXH3-128"
 	// HashHighway is HighwayHash-128, a robust and fast PRF.
 	HashHighway = "HIGHWAYHASH"
 	// HashWyhash is the 64-bit Wyhash algorithm, known for its extreme speed.
 	HashWyhash = "WYHASH"
+	// HashBlake2b256 is the 256-bit BLAKE2b cryptographic hash, optimized for 64-bit platforms.
+	HashBlake2b256 = "BLAKE2B-256"
+	// HashBlake2s256 is the 256-bit BLAKE2s cryptographic hash, optimized for 8 to 32-bit platforms.
+	HashBlake2s256 = "BLAKE2S-256"
 	// HashBlake3 is the Blake3 cryptographic hash, designed for extreme speed and security.
 	HashBlake3 = "BLAKE3"
 )
 
+// supportedTypes lists every built-in hash type accepted by getFactory, in the order they are documented.
+var supportedTypes = []string{
+	HashMD5, HashSHA1, HashSHA256, HashSHA384, HashSHA512, HashSHA3_256, HashSHA3_512,
+	HashCRC32, HashCRC32C, HashCRC64, HashCRC64ISO, HashXXH3_64, HashXXH3, HashHighway, HashWyhash,
+	HashBlake2b256, HashBlake2s256, HashBlake3,
+}
+
+// ErrUnsupportedHash is returned, wrapped with the requested name, when a hash type is neither
+// built-in nor registered, so that callers can tell it apart with errors.Is:
+//
+//	hf, err := hasher.GetHasher(name)
+//	if errors.Is(err, hasher.ErrUnsupportedHash) {
+//		http.Error(w, err.Error(), http.StatusBadRequest)
+//		return
+//	}
+var ErrUnsupportedHash = errors.New("unsupported hash type")
+
+// aliases maps common alternative spellings of hash types, in uppercase, to their name.
+// XXH64 and XXHASH are deliberately absent: they denote the original 64-bit xxHash,
+// whose digests differ from those of XXH3.
+var aliases = map[string]string{
+	"SHA-1":   HashSHA1,
+	"SHA-256": HashSHA256,
+	"SHA-384": HashSHA384,
+	"SHA-512": HashSHA512,
+	"XXH3-64": HashXXH3_64,
+	"XXH128":  HashXXH3,
+}
+
+// CanonicalType returns the name under which a hash type is supported, so that "sha256",
+// " Sha256 " and "SHA-256" all return "SHA256". Names added with Register are matched
+// case-insensitively too. An unsupported type returns an error listing the supported ones.
+func CanonicalType(hashType string) (string, error) {
+	name := strings.TrimSpace(hashType)
+	if _, ok := registered(name); ok {
+		return name, nil
+	}
+	for _, custom := range registeredNames() {
+		if strings.EqualFold(custom, name) {
+			return custom, nil
+		}
+	}
+	name = strings.ToUpper(name)
+	if alias, ok := aliases[name]; ok {
+		name = alias
+	}
+	if !slices.Contains(supportedTypes, name) {
+		return "", fmt.Errorf("%w: %s (supported: %s)", ErrUnsupportedHash, hashType, strings.Join(SupportedHashes(), ", "))
+	}
+	return name, nil
+}
+
+// SupportedHashes returns the names of all supported hash types: the built-in types in the
+// order they are documented, followed by the names added with Register in alphabetical order.
+func SupportedHashes() []string {
+	return slices.Concat(supportedTypes, registeredNames())
+}
+
+// Precomputed CRC tables shared by all hasher instances.
+var (
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+	crc64ECMATable  = crc64.MakeTable(crc64.ECMA)
+	crc64ISOTable   = crc64.MakeTable(crc64.ISO)
+)
+
 // Func is a function type that takes a reader and returns a hash string or an error.
 type Func func(io.Reader) (string, error)
 
+// FuncAt is a function type that hashes the first size bytes of a random-access input, such
+// as an *os.File or a memory-mapped file, and returns a hash string or an error. Unlike Func,
+// it lets an algorithm read parts of the input out of order or concurrently.
+type FuncAt func(r io.ReaderAt, size int64) (string, error)
+
+// At adapts a streaming Func to a FuncAt, reading the input sequentially through an
+// io.SectionReader.
+func (hf Func) At() FuncAt {
+	return func(r io.ReaderAt, size int64) (string, error) {
+		return hf(io.NewSectionReader(r, 0, size))
+	}
+}
+
+// MultiFunc is a function type that takes a reader and returns the digests of
+// several algorithms, keyed by hash type, computed in a single pass.
+type MultiFunc func(io.Reader) (map[string]string, error)
+
+// Options configures the digests computed by NewMultiHasher.
+type Options struct {
+	// Key computes HMAC digests keyed with it when non-nil.
+	Key []byte
+	// Blake3Key computes the BLAKE3 digests in keyed mode with it when non-nil. It must be
+	// Blake3KeySize bytes long, and cannot be combined with Key or Blake3Context.
+	Blake3Key []byte
+	// Blake3Context computes the BLAKE3 digests in key derivation mode with this context when
+	// non-empty, deriving keys from the input as its key material.
+	Blake3Context string
+	// Blake3Length reads BLAKE3 digests of this many bytes from its extendable output when
+	// positive, instead of the Blake3Size bytes of the default digest.
+	Blake3Length int
+	// Encoding renders the raw digests; nil selects lowercase hex.
+	Encoding Encoding
+}
+
 // GetHasher returns the appropriate hash function based on the requested hash type.
-// It returns a Func that can process an io.Reader and an error if the type is unsupported.
+// It returns a Func that can process an io.Reader, or an error wrapping ErrUnsupportedHash
+// if the type is unsupported.
 func GetHasher(hashType string) (Func, error) {
+	newHasher, err := getFactory(hashType)
+	if err != nil {
+		return nil, err
+	}
+	return newHashStreamFunc(newHasher, hex.EncodeToString), nil
+}
+
+// GetHasherAt returns the FuncAt of the requested hash type, or an error wrapping
+// ErrUnsupportedHash if the type is unsupported. The CRC checksums split large inputs into
+// parts hashed concurrently, one per CPU, and combine their checksums; the other algorithms
+// read the input sequentially as GetHasher does. The digests are the same either way.
+func GetHasherAt(hashType string) (FuncAt, error) {
+	newHasher, err := getFactory(hashType)
+	if err != nil {
+		return nil, err
+	}
+	name, _ := CanonicalType(hashType) // #nosec G104 -- getFactory already accepted the type
+	if _, custom := registered(name); !custom {
+		if crc, ok := crcPolys[name]; ok {
+			return crc.at(newHasher, runtime.GOMAXPROCS(0), minCRCChunk), nil
+		}
+	}
+	return newHashStreamFunc(newHasher, hex.EncodeToString).At(), nil
+}
+
+// GetMultiHasher returns a MultiFunc computing every requested hash type at once.
+// The reader is consumed a single time and fanned out to all hashes through an io.MultiWriter,
+// so adding algorithms costs CPU time but no additional I/O.
+func GetMultiHasher(hashTypes []string) (MultiFunc, error) {
+	return NewMultiHasher(hashTypes, Options{})
+}
+
+// NewMultiHasher returns a MultiFunc computing every requested hash type at once,
+// as configured by opts.
+func NewMultiHasher(hashTypes []string, opts Options) (MultiFunc, error) {
+	factory := getFactory
+	if opts.Key != nil {
+		factory = func(hashType string) (func() hash.Hash, error) {
+			return getHMACFactory(hashType, opts.Key)
+		}
+	}
+	if opts.Blake3Key != nil || opts.Blake3Context != "" || (opts.Blake3Length != 0 && opts.Blake3Length != Blake3Size) {
+		newBlake3, err := getBlake3Factory(opts)
+		if err != nil {
+			return nil, err
+		}
+		base := factory
+		factory = func(hashType string) (func() hash.Hash, error) {
+			if name, err := CanonicalType(hashType); err == nil && name == HashBlake3 {
+				return newBlake3, nil
+			}
+			return base(hashType)
+		}
+	}
+	encode := opts.Encoding
+	if encode == nil {
+		encode = hex.EncodeToString
+	}
+	return getMultiHasher(hashTypes, factory, encode)
+}
+
+// GetHMACHasher returns a Func computing the HMAC of the requested hash type with the given key.
+// Only cryptographic hash types can be used; the checksums and non-cryptographic hashes are rejected.
+func GetHMACHasher(hashType string, key []byte) (Func, error) {
+	newHasher, err := getHMACFactory(hashType, key)
+	if err != nil {
+		return nil, err
+	}
+	return newHashStreamFunc(newHasher, hex.EncodeToString), nil
+}
+
+// GetMultiHMACHasher returns a MultiFunc computing the HMAC of every requested hash type
+// with the given key in a single pass. The results are keyed by the plain hash type.
+func GetMultiHMACHasher(hashTypes []string, key []byte) (MultiFunc, error) {
+	return NewMultiHasher(hashTypes, Options{Key: key})
+}
+
+// getMultiHasher builds a MultiFunc from the constructors returned by factory for each hash type,
+// rendering the digests with encode.
+func getMultiHasher(hashTypes []string, factory func(hashType string) (func() hash.Hash, error), encode Encoding) (MultiFunc, error) {
+	if len(hashTypes) == 0 {
+		return nil, fmt.Errorf("no hash type specified")
+	}
+	factories := make(map[string]func() hash.Hash, len(hashTypes))
+	seen := make(map[string]bool, len(hashTypes))
+	for _, hashType := range hashTypes {
+		// Spellings of the same type, such as "sha256" and "SHA256", are duplicates too.
+		name, err := CanonicalType(hashType)
+		if err != nil {
+			return nil, err
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate hash type: %s", hashType)
+		}
+		seen[name] = true
+		newHasher, err := factory(hashType)
+		if err != nil {
+			return nil, err
+		}
+		factories[hashType] = newHasher
+	}
+	return newMultiHashStreamFunc(factories, encode), nil
+}
+
+// getHMACFactory returns the constructor of an HMAC keyed with key over the requested hash type.
+func getHMACFactory(hashType string, key []byte) (func() hash.Hash, error) {
+	name, err := CanonicalType(hashType)
+	if err != nil {
+		return nil, err
+	}
+	newHasher, err := getFactory(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, custom := registered(name); custom || !isCryptographic(name) {
+		return nil, fmt.Errorf("HMAC requires a cryptographic hash type: %s", hashType)
+	}
+	return func() hash.Hash { return hmac.New(newHasher, key) }, nil
+}
+
+// Sizes of the BLAKE3 keys and default digests, in bytes.
+const (
+	Blake3KeySize = 32
+	Blake3Size    = 32
+)
+
+// getBlake3Factory returns the constructor of BLAKE3 in the keyed or key derivation mode and
+// with the output length selected by opts, after checking that the modes are not combined,
+// the key size and the length.
+func getBlake3Factory(opts Options) (func() hash.Hash, error) {
+	if opts.Key != nil {
+		return nil, errors.New("the BLAKE3 keyed and key derivation modes and output length cannot be combined with HMAC")
+	}
+	if opts.Blake3Length < 0 {
+		return nil, fmt.Errorf("BLAKE3 output length must be positive: %d", opts.Blake3Length)
+	}
+	newHasher := blake3.New
+	switch {
+	case opts.Blake3Context != "" && opts.Blake3Key != nil:
+		return nil, errors.New("the BLAKE3 keyed and key derivation modes cannot be combined")
+	case opts.Blake3Context != "":
+		newHasher = func() *blake3.Hasher { return blake3.NewDeriveKey(opts.Blake3Context) }
+	case opts.Blake3Key != nil:
+		if len(opts.Blake3Key) != Blake3KeySize {
+			return nil, fmt.Errorf("BLAKE3 key is %d bytes long, expected %d", len(opts.Blake3Key), Blake3KeySize)
+		}
+		newHasher = func() *blake3.Hasher {
+			h, _ := blake3.NewKeyed(opts.Blake3Key) // #nosec G104 -- the key size is checked above
+			return h
+		}
+	}
+	if opts.Blake3Length == 0 || opts.Blake3Length == Blake3Size {
+		return func() hash.Hash { return newHasher() }, nil
+	}
+	return func() hash.Hash { return &blake3XOF{Hasher: newHasher(), size: opts.Blake3Length} }, nil
+}
+
+// blake3XOF is a BLAKE3 hasher whose digests are read from its extendable output, so that
+// they can be longer or shorter than the default ones. Shorter digests are prefixes of the
+// default ones, and longer digests extend them.
+type blake3XOF struct {
+	*blake3.Hasher
+	size int
+}
+
+// Size returns the length of the digests, in bytes.
+func (h *blake3XOF) Size() int {
+	return h.size
+}
+
+// Sum appends the digest of the data written so far to b, without changing the hash state.
+func (h *blake3XOF) Sum(b []byte) []byte {
+	out := make([]byte, h.size)
+	_, _ = h.Digest().Read(out) // #nosec G104 -- reading the extendable output never fails
+	return append(b, out...)
+}
+
+// isCryptographic reports whether the hash type is a cryptographic hash suitable for HMAC.
+func isCryptographic(hashType string) bool {
 	switch hashType {
+	case HashMD5, HashSHA1, HashSHA256, HashSHA384, HashSHA512, HashSHA3_256, HashSHA3_512,
+		HashBlake2b256, HashBlake2s256, HashBlake3:
+		return true
+	default:
+		return false
+	}
+}
+
+// getFactory returns the constructor of the hash.Hash matching the requested hash type,
+// in any spelling accepted by CanonicalType, looking up the algorithms added with Register
+// before the built-in types.
+func getFactory(hashType string) (func() hash.Hash, error) {
+	name, err := CanonicalType(hashType)
+	if err != nil {
+		return nil, err
+	}
+	if newHasher, ok := registered(name); ok {
+		return newHasher, nil
+	}
+	switch name {
 	case HashMD5:
 		// #nosec G401 -- MD5 is supported as a legacy hash option for file integrity verification, not for security-critical contexts.
-		return newHashStreamFunc(md5.New), nil
+		return md5.New, nil
 	case HashSHA1:
 		// #nosec G401 -- SHA1 is supported as a legacy hash option for file integrity verification, not for security-critical contexts.
-		return newHashStreamFunc(sha1.New), nil
+		return sha1.New, nil
 	case HashSHA256:
-		return newHashStreamFunc(sha256.New), nil
+		return sha256.New, nil
+	case HashSHA384:
+		return sha512.New384, nil
+	case HashSHA512:
+		return sha512.New, nil
+	case HashSHA3_256:
+		return func() hash.Hash { return sha3.New256() }, nil
+	case HashSHA3_512:
+		return func() hash.Hash { return sha3.New512() }, nil
+	case HashCRC32:
+		return func() hash.Hash { return crc32.NewIEEE() }, nil
+	case HashCRC32C:
+		return func() hash.Hash { return crc32.New(castagnoliTable) }, nil
+	case HashCRC64:
+		return func() hash.Hash { return crc64.New(crc64ECMATable) }, nil
+	case HashCRC64ISO:
+		return func() hash.Hash { return crc64.New(crc64ISOTable) }, nil
+	case HashXXH3_64:
+		// Uses zeebo/xxh3 implementation for 64-bit hashes.
+		return func() hash.Hash { return xxh3.New() }, nil
 	case HashXXH3:
 		// Uses zeebo/xxh3 implementation for 128-bit hashes.
-		return newHashStreamFunc(func() hash.Hash { return xxh3.New128() }), nil
+		return func() hash.Hash { return xxh3.New128() }, nil
 	case HashHighway:
 		// Uses minio/highwayhash with a standardized fixed key.
-		return hashHighwayStream, nil
+		return newHighway, nil
 	case HashWyhash:
 		// Uses orisano/wyhash with a standardized fixed seed.
-		return hashWyhashStream, nil
+		return newWyhash, nil
+	case HashBlake2b256:
+		// Uses golang.org/x/crypto/blake2b in unkeyed mode.
+		return unkeyed(blake2b.New256), nil
+	case HashBlake2s256:
+		// Uses golang.org/x/crypto/blake2s in unkeyed mode.
+		return unkeyed(blake2s.New256), nil
 	case HashBlake3:
 		// Uses zeebo/blake3 for high-performance cryptographic hashing.
-		return newHashStreamFunc(func() hash.Hash { return blake3.New() }), nil
+		return func() hash.Hash { return blake3.New() }, nil
 	default:
-		return nil, fmt.Errorf("unsupported hash type: %s", hashType)
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedHash, hashType)
 	}
 }
 
 // newHashStreamFunc creates a Func from a function that returns a new hash.Hash.
-func newHashStreamFunc(newHasher func() hash.Hash) Func {
+func newHashStreamFunc(newHasher func() hash.Hash, encode Encoding) Func {
 	return func(r io.Reader) (string, error) {
-		h := newHasher()
-		if _, err := io.Copy(h, r); err != nil {
+		digest, err := sumStream(newHasher(), r)
+		if err != nil {
 			return "", err
 		}
-		return hex.EncodeToString(h.Sum(nil)), nil
+		return encode(digest), nil
 	}
 }
 
-// hashHighwayStream computes HighwayHash using a fixed all-zeros 32-byte key.
-func hashHighwayStream(r io.Reader) (string, error) {
-	key := make([]byte, 32) // Fixed all-zeros key
-	h, err := highwayhash.New128(key)
-	if err != nil {
-		return "", err
-	}
+// sumStream writes the whole reader to h and returns the raw digest.
+// The digest of every hash type, including the 64-bit checksums, is the big-endian byte representation.
+func sumStream(h hash.Hash, r io.Reader) ([]byte, error) {
 	if _, err := io.Copy(h, r); err != nil {
-		return "", err
+		return nil, err
 	}
-	return hex.EncodeToString(h.Sum(nil)), nil
+	return h.Sum(nil), nil
 }
 
-// hashWyhashStream computes Wyhash using a fixed seed of 0.
-func hashWyhashStream(r io.Reader) (string, error) {
-	h := wyhash.New(0)
-	if _, err := io.Copy(h, r); err != nil {
+// newMultiHashStreamFunc creates a MultiFunc from a set of hash.Hash constructors keyed by hash type.
+func newMultiHashStreamFunc(factories map[string]func() hash.Hash, encode Encoding) MultiFunc {
+	return func(r io.Reader) (map[string]string, error) {
+		hashes := make(map[string]hash.Hash, len(factories))
+		writers := make([]io.Writer, 0, len(factories))
+		for hashType, newHasher := range factories {
+			h := newHasher()
+			hashes[hashType] = h
+			writers = append(writers, h)
+		}
+		if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+			return nil, err
+		}
+		digests := make(map[string]string, len(hashes))
+		for hashType, h := range hashes {
+			digests[hashType] = encode(h.Sum(nil))
+		}
+		return digests, nil
+	}
+}
+
+// unkeyed adapts a keyed hash constructor to the func() hash.Hash signature
+// expected by newHashStreamFunc by always passing a nil key.
+// With a nil key the constructors cannot fail, so the error is discarded.
+func unkeyed(newKeyed func(key []byte) (hash.Hash, error)) func() hash.Hash {
+	return func() hash.Hash {
+		h, _ := newKeyed(nil) // #nosec G104 -- a nil key is always valid
+		return h
+	}
+}
+
+// highwayKey is the fixed all-zeros 32-byte key used for HighwayHash.
+var highwayKey = make([]byte, 32)
+
+// newHighway creates a HighwayHash-128 instance using the fixed all-zeros key.
+// The key has the required 32-byte length, so the error is discarded.
+func newHighway() hash.Hash {
+	h, _ := highwayhash.New128(highwayKey) // #nosec G104 -- the key length is always valid
+	return h
+}
+
+// newWyhash creates a Wyhash instance using a fixed seed of 0.
+func newWyhash() hash.Hash {
+	return wyhash.New(0)
+}
+
+// HashPath opens the file at path and returns its digest computed by hf.
+// It lets other programs hash individual files without walking a directory.
+// The path is used as given and is not confined to a root directory.
+func HashPath(path string, hf Func) (digest string, err error) {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
 		return "", err
 	}
-	return hex.EncodeToString(h.Sum(nil)), nil
+	defer func() {
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	return hf(file)
 }
@@ -0,0 +1,170 @@
+package hasher
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// TestNewMultiHasherHMACDefaultBlake3Length checks that the default BLAKE3 length, given
+// explicitly, does not select the BLAKE3 modes, which cannot be combined with HMAC.
+func TestNewMultiHasherHMACDefaultBlake3Length(t *testing.T) {
+	key := []byte("k2")
+	for _, length := range []int{0, Blake3Size} {
+		hf, err := NewMultiHasher([]string{HashSHA256}, Options{Key: key, Blake3Length: length})
+		if err != nil {
+			t.Fatalf("length %d: %v", length, err)
+		}
+		digests, err := hf(strings.NewReader("abc"))
+		if err != nil {
+			t.Fatalf("length %d: %v", length, err)
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte("abc"))
+		if want := hex.EncodeToString(mac.Sum(nil)); digests[HashSHA256] != want {
+			t.Errorf("length %d: got %s, want %s", length, digests[HashSHA256], want)
+		}
+	}
+	if _, err := NewMultiHasher([]string{HashBlake3}, Options{Key: key, Blake3Length: 64}); err == nil {
+		t.Error("HMAC with a BLAKE3 length of 64 was accepted")
+	}
+}
+
+// digest returns the hex digest of data computed by GetHasher for hashType.
+func digest(t *testing.T, hashType string, data []byte) string {
+	t.Helper()
+	hf, err := GetHasher(hashType)
+	if err != nil {
+		t.Fatalf("%s: %v", hashType, err)
+	}
+	sum, err := hf(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%s: %v", hashType, err)
+	}
+	return sum
+}
+
+// TestSHA3Vectors checks the SHA-3 hash types against the digests published by NIST for the
+// empty and "abc" messages.
+func TestSHA3Vectors(t *testing.T) {
+	tests := []struct {
+		hashType, input, want string
+	}{
+		{HashSHA3_256, "", "a7ffc6f8bf1ed76651c14756a061d662f580ff4de43b49fa82d80a4b80f8434a"},
+		{HashSHA3_256, "abc", "3a985da74fe225b2045c172d6bd390bd855f086e3e9d525b46bfe24511431532"},
+		{HashSHA3_512, "", "a69f73cca23a9ac5c8b567dc185a756e97c982164fe25859e0d1dcc1475c80a615b2123af1f5f94c11e3e9402c3ac558f500199d95b6d3e301758586281dcd26"},
+		{HashSHA3_512, "abc", "b751850b1a57168a5693cd924b6b096e08f621827444f70d884f5d0240d2712e10e116e9192af3c91a7ec57647e3934057340b4cf408d5a56592f8274eec53f0"},
+	}
+	for _, tt := range tests {
+		if got := digest(t, tt.hashType, []byte(tt.input)); got != tt.want {
+			t.Errorf("%s(%q) = %s, want %s", tt.hashType, tt.input, got, tt.want)
+		}
+	}
+}
+
+// TestBlake2Vectors checks the BLAKE2 hash types against the "abc" vector of RFC 7693
+// Appendix B for BLAKE2s-256, and against golden digests of the reference implementation for
+// BLAKE2b-256, whose 256-bit variant the RFC does not list.
+func TestBlake2Vectors(t *testing.T) {
+	tests := []struct {
+		hashType, input, want string
+	}{
+		{HashBlake2s256, "abc", "508c5e8c327c14e2e1a72ba34eeb452f37458b209ed63a294d999b4c86675982"},
+		{HashBlake2s256, "", "69217a3079908094e11121d042354a7c1f55b6482ca1a51e1b250dfd1ed0eef9"},
+		{HashBlake2b256, "abc", "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319"},
+		{HashBlake2b256, "", "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8"},
+	}
+	for _, tt := range tests {
+		if got := digest(t, tt.hashType, []byte(tt.input)); got != tt.want {
+			t.Errorf("%s(%q) = %s, want %s", tt.hashType, tt.input, got, tt.want)
+		}
+	}
+}
+
+// TestCRC64 checks the CRC-64 hash types against the check values of the CRC catalogue for
+// "123456789", and against golden digests of a deterministic 1 MiB buffer, so that the
+// polynomials and the big-endian rendering of the sums cannot change unnoticed.
+func TestCRC64(t *testing.T) {
+	buf := make([]byte, 1<<20)
+	for i := range buf {
+		buf[i] = byte(i * 7 % 251)
+	}
+	tests := []struct {
+		name     string
+		hashType string
+		input    []byte
+		want     string
+	}{
+		{"ECMA check", HashCRC64, []byte("123456789"), "995dc9bbdf1939fa"},
+		{"ECMA 1MiB", HashCRC64, buf, "9efb03a8959e2928"},
+		{"ISO check", HashCRC64ISO, []byte("123456789"), "b90956c775a41001"},
+		{"ISO 1MiB", HashCRC64ISO, buf, "cfba46f19069d009"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := digest(t, tt.hashType, tt.input); got != tt.want {
+				t.Errorf("%s = %s, want %s", tt.hashType, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestMultiHasherParity checks that computing every supported hash type in a single pass
+// gives the same digests as computing each of them separately.
+func TestMultiHasherParity(t *testing.T) {
+	data := bytes.Repeat([]byte("hashcalcmt parity "), 10000)
+	hashTypes := SupportedHashes()
+	hf, err := GetMultiHasher(hashTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digests, err := hf(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(digests) != len(hashTypes) {
+		t.Errorf("got %d digests, want %d", len(digests), len(hashTypes))
+	}
+	for _, hashType := range hashTypes {
+		if want := digest(t, hashType, data); digests[hashType] != want {
+			t.Errorf("%s: single pass %s, separate %s", hashType, digests[hashType], want)
+		}
+	}
+}
+
+// TestCRCAt checks that the CRCs computed in parallel parts of a random-access input, combined
+// into one, are the streaming digests, whatever the number and size of the parts.
+func TestCRCAt(t *testing.T) {
+	data := make([]byte, 1<<20+7)
+	for i := range data {
+		data[i] = byte(i * 7 % 251)
+	}
+	for hashType, crc := range crcPolys {
+		newHasher, err := getFactory(hashType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, size := range []int{0, 1, 1000, len(data)} {
+			want := digest(t, hashType, data[:size])
+			for _, parts := range []int{1, 2, 3, 16} {
+				got, err := crc.at(newHasher, parts, 1)(bytes.NewReader(data), int64(size))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Errorf("%s of %d bytes in %d parts = %s, want %s", hashType, size, parts, got, want)
+				}
+			}
+		}
+		hf, err := GetHasherAt(hashType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := hf(bytes.NewReader(data[:10]), 20); err == nil {
+			t.Errorf("%s: no error on an input shorter than its size", hashType)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package hasher
+
+import (
+	"hash"
+	"slices"
+	"sync"
+)
+
+// registry holds the hash algorithms added with Register, keyed by name.
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]func() hash.Hash)
+)
+
+// Register makes a custom hash algorithm available under name to GetHasher, the multi-hashers
+// and therefore the --hash flag of programs built with this package, such as a proprietary
+// checksum:
+//
+//	func init() {
+//		hasher.Register("ACMESUM", acmesum.New)
+//	}
+//
+// The registry is consulted before the built-in hash types, so registering a built-in name
+// replaces it, and registering a name again replaces the previous factory. Registered
+// algorithms cannot be used for HMAC, which is limited to the built-in cryptographic hashes.
+//
+// Register is safe for concurrent use with the other functions of the package. A hasher
+// resolves its algorithms when it is created, so a registration only affects the hashers
+// created afterwards; registering from an init function makes the algorithm available
+// everywhere. It panics if name is empty or factory is nil.
+func Register(name string, factory func() hash.Hash) {
+	if name == "" || factory == nil {
+		panic("hasher: Register requires a name and a factory")
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[name] = factory
+}
+
+// registered returns the factory registered under name, if any.
+func registered(name string) (func() hash.Hash, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	factory, ok := registry[name]
+	return factory, ok
+}
+
+// registeredNames returns the names of the registered algorithms that are not built-in, sorted.
+func registeredNames() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	var names []string
+	for name := range registry {
+		if !slices.Contains(supportedTypes, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// manifestHeader describes how a manifest was generated, written with --header: as "# key: value"
+// comment lines with the line formats, or as a "header" object with the JSON formats.
+type manifestHeader struct {
+	Version    string    `json:"version"`
+	Generated  time.Time `json:"generated"`
+	Algorithms []string  `json:"algorithms"`
+	Encoding   string    `json:"encoding"`
+	Truncate   int       `json:"truncate,omitempty"`
+	Blake3Len  int       `json:"blake3_length,omitempty"`
+	Host       string    `json:"host"`
+	Root       string    `json:"root"`
+}
+
+// newManifestHeader returns the header of a run started at the given time. The root is the
+// absolute path of --path, or "-" for standard input.
+func newManifestHeader(cfg *Config, started time.Time) *manifestHeader {
+	algorithms := make([]string, len(cfg.HashTypes))
+	for i, hashType := range cfg.HashTypes {
+		algorithms[i] = cfg.algorithm(hashType)
+	}
+	root := cfg.absRoot
+	if cfg.Stdin {
+		root = stdinPath
+	} else if cfg.remote {
+		root = cfg.Path
+	}
+	host, _ := os.Hostname() // #nosec G104 -- the host is informational and left empty when unknown
+	return &manifestHeader{
+		Version:    version,
+		Generated:  started.UTC().Truncate(time.Second),
+		Algorithms: algorithms,
+		Encoding:   cfg.Encoding,
+		Truncate:   cfg.Truncate,
+		Blake3Len:  cfg.blake3Length(),
+		Host:       host,
+		Root:       root,
+	}
+}
+
+// lines renders the header as comment lines, which --check and coreutils tools skip.
+// The truncation and the BLAKE3 length are only written when they differ from the defaults.
+func (h *manifestHeader) lines() []string {
+	lines := []string{
+		"# version: " + h.Version,
+		"# generated: " + h.Generated.Format(time.RFC3339),
+		"# algorithms: " + strings.Join(h.Algorithms, ", "),
+		"# encoding: " + h.Encoding,
+	}
+	if h.Truncate > 0 {
+		lines = append(lines, "# truncate: "+strconv.Itoa(h.Truncate))
+	}
+	if h.Blake3Len > 0 {
+		lines = append(lines, "# blake3-length: "+strconv.Itoa(h.Blake3Len))
+	}
+	return append(lines, "# host: "+h.Host, "# root: "+h.Root)
+}
+
+// readManifestHeader reads the generation time, the algorithms and the encoding from the
+// header of a manifest: the comment lines at the top of a text or coreutils manifest, or the
+// first line of an ndjson manifest. A manifest without a header returns an empty one.
+func readManifestHeader(filename string) (header manifestHeader, err error) {
+	file, err := os.Open(filepath.Clean(filename))
+	if err != nil {
+		return header, err
+	}
+	defer func() {
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(line, `{"header":`) {
+			var record struct {
+				Header manifestHeader `json:"header"`
+			}
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				return header, fmt.Errorf("%s: invalid header: %w", filename, err)
+			}
+			return record.Header, nil
+		}
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		key, value, ok := strings.Cut(strings.TrimSpace(strings.TrimPrefix(line, "#")), ": ")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "generated":
+			if header.Generated, err = time.Parse(time.RFC3339, value); err != nil {
+				return header, fmt.Errorf("%s: invalid header: %w", filename, err)
+			}
+		case "algorithms":
+			header.Algorithms = parseHashTypes(value)
+		case "encoding":
+			header.Encoding = value
+		case "truncate":
+			if header.Truncate, err = strconv.Atoi(value); err != nil {
+				return header, fmt.Errorf("%s: invalid header: %w", filename, err)
+			}
+		case "blake3-length":
+			if header.Blake3Len, err = strconv.Atoi(value); err != nil {
+				return header, fmt.Errorf("%s: invalid header: %w", filename, err)
+			}
+		}
+	}
+	return header, scanner.Err()
+}
+
+// useManifestHeader selects the hash types, the encoding, the truncation and the BLAKE3 length
+// of the --check manifest, unless they are given on the command line. The hash types are those
+// named by its "path (TYPE): hash" lines, or else those recorded in its header; a manifest of
+// metadata fingerprints is checked with --fast-fingerprint. A manifest without a header or
+// named algorithms leaves the configuration as is.
+func (cfg *Config) useManifestHeader() error {
+	header, err := readManifestHeader(cfg.Check)
+	if err != nil {
+		return err
+	}
+	if !cfg.hashSet {
+		entries, err := readManifest(cfg.Check)
+		if err != nil {
+			return err
+		}
+		algorithms := header.Algorithms
+		if named := manifestAlgorithms(entries); len(named) > 0 {
+			algorithms = named
+		}
+		if len(algorithms) > 0 {
+			hashTypes := make([]string, len(algorithms))
+			keyGiven := map[string]bool{"hmac-key": cfg.HMACKey != "", "blake3-key": cfg.Blake3Key != "", "blake3-derive-context": cfg.Blake3Ctx != ""}
+			for i, algorithm := range algorithms {
+				hashType, keyFlag, fingerprint, err := digestHashType(algorithm)
+				if err != nil {
+					return fmt.Errorf("the manifest lists %s digests: %w", algorithm, err)
+				}
+				if keyFlag != "" && !keyGiven[keyFlag] {
+					return fmt.Errorf("the manifest was generated with %s, which requires --%s", algorithm, keyFlag)
+				}
+				hashTypes[i] = hashType
+				cfg.Fingerprint = cfg.Fingerprint || fingerprint
+			}
+			cfg.HashTypes = hashTypes
+		}
+	}
+	if !cfg.encodingSet && header.Encoding != "" {
+		cfg.Encoding = header.Encoding
+	}
+	if !cfg.truncateSet {
+		cfg.Truncate = header.Truncate
+	}
+	if !cfg.b3LenSet && header.Blake3Len > 0 {
+		cfg.Blake3Len = header.Blake3Len
+	}
+	return nil
+}
+
+// manifestAlgorithms returns the algorithms named by the entries of a manifest, in the order
+// they first appear.
+func manifestAlgorithms(entries []manifestEntry) []string {
+	var algorithms []string
+	for _, entry := range entries {
+		if entry.Algorithm != "" && !slices.Contains(algorithms, entry.Algorithm) {
+			algorithms = append(algorithms, entry.Algorithm)
+		}
+	}
+	return algorithms
+}
+
+// manifestTime returns the time a manifest was generated, read from its header, or its
+// modification time when it has none. The modification time is that of the end of the run,
+// so that the files modified while it was running are not accounted for.
+func manifestTime(filename string) (time.Time, error) {
+	header, err := readManifestHeader(filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !header.Generated.IsZero() {
+		return header.Generated, nil
+	}
+	info, err := os.Stat(filepath.Clean(filename))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
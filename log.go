@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Log formats accepted by --log-format.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logger receives the diagnostics of a run: the errors and warnings on files and directories,
+// the per-file timings and the summary. The results themselves are written to standard output
+// or to the output file, never to the log. It is replaced by newLogger once the flags are parsed.
+var logger = slog.Default()
+
+// newLogger returns a logger writing records of at least the given level (debug, info, warn
+// or error) to w, as logfmt key=value lines or as JSON objects.
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid --log-level %q: expected debug, info, warn or error", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch strings.ToLower(format) {
+	case logFormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case logFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid --log-format %q: expected %s or %s", format, logFormatText, logFormatJSON)
+	}
+}
+
+// logError logs an error at the given level. The operation and the path of a fileError are
+// logged as separate attributes, so that they can be filtered on. Errors of the whole run,
+// without a path, are logged as is.
+func logError(level slog.Level, err error) {
+	var fe *fileError
+	if errors.As(err, &fe) {
+		if fe.Path == "" {
+			err = fe.Err
+		} else {
+			logger.Log(context.Background(), level, "error "+fe.Op+" file", "path", fe.Path, "error", fe.Err)
+			return
+		}
+	}
+	logger.Log(context.Background(), level, err.Error())
+}
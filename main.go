@@ -1,11 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"criticalsys.net/hashcalcmt/hasher"
 	"criticalsys.net/hashcalcmt/pipeline"
@@ -13,16 +29,134 @@ import (
 
 var version string
 
+// stdinPath is the conventional name designating standard input.
+const stdinPath = "-"
+
+// Exit statuses of the tool.
+const (
+	// exitFileErrors reports that some files could not be processed, or did not verify with --check.
+	exitFileErrors = 1
+	// exitFatal reports an invalid configuration or a failure affecting the whole run,
+	// matching the status of the flag package on a usage error.
+	exitFatal = 2
+	// exitInterrupted is the exit status of a run stopped by a signal, following the 128+SIGINT shell convention.
+	exitInterrupted = 130
+)
+
 // Config holds the application configuration.
 type Config struct {
 	FilePattern string
+	MatchPath   bool
+	IgnoreCase  bool
+	Excludes    stringList
+	Regex       string
+	RegexFull   bool
+	regex       *regexp.Regexp
+	MinSize     string
+	MaxSize     string
+	minSize     int64
+	maxSize     int64
+	ModAfter    string
+	ModBefore   string
+	NewerThan   string
+	modAfter    time.Time
+	modBefore   time.Time
+	MaxDepth    int
+	MaxFiles    int
+	Follow      bool
+	LinkTarget  bool
+	SkipHidden  bool
+	SkipEmpty   bool
+	Hardlinks   bool
+	Metadata    bool
+	Restat      bool
+	EmptyAs     string
+	GitIgnore   bool
 	Path        string
 	HashType    string
+	hashSet     bool
+	HashTypes   []string
+	HMACKey     string
+	hmacKey     []byte
+	Blake3Key   string
+	blake3Key   []byte
+	Blake3Ctx   string
+	Blake3Len   int
+	b3LenSet    bool
+	Encoding    string
+	encodingSet bool
+	encoding    hasher.Encoding
+	Uppercase   bool
+	Truncate    int
+	truncateSet bool
 	OutFile     string
+	ShardDir    string
+	ShardLen    int
+	Append      bool
+	PathStyle   string
+	Header      bool
+	Length      string
+	length      int64
+	Tail        string
+	tail        int64
+	Fingerprint bool
+	ConfigFile  string
+	Benchmark   bool
+	BenchSize   string
+	benchSize   int64
+	header      *manifestHeader
+	absRoot     string
+	SQLite      string
+	S3          string
+	Webhook     string
+	HookBatch   int
+	HookTimeout time.Duration
+	Cache       string
+	FilesFrom   string
+	FilesFrom0  string
+	listNUL     bool
+	files       []string
+	cache       *hashCache
+	Format      string
+	SumStyle    string
+	LineTmpl    string
+	JSONErrors  bool
+	Check       string
+	Compare     string
+	Stdin       bool
+	remote      bool
+	HTTPTimeout time.Duration
+	urls        []string
+	Progress    bool
 	Rename      bool
+	RenameTmpl  string
+	RenameDir   string
+	CopyTo      string
+	OnCollision string
+	DryRun      bool
+	CountOnly   bool
+	Dedup       bool
+	TreeHash    bool
+	FailFast    bool
+	SkipErrors  bool
 	Display     bool
+	Quiet       bool
+	Verbose     bool
+	LogLevel    string
+	LogFormat   string
 	Version     bool
+	ListHashes  bool
+	Workers     string
 	NumWorkers  int
+	IOLimit     int
+	MaxRate     string
+	maxRate     int64
+	BufferSize  string
+	bufferSize  int64
+	Archives    bool
+	Mmap        bool
+	MmapMin     string
+	mmapMin     int64
 }
 
 // main is the entry point of the Hash MT Generator tool.
@@ -35,99 +169,1278 @@ func main() {
 		os.Exit(0)
 	}
 
-	hf, err := hasher.GetHasher(cfg.HashType)
+	if cfg.ListHashes {
+		for _, hashType := range hasher.SupportedHashes() {
+			fmt.Println(hashType)
+		}
+		os.Exit(0)
+	}
+
+	if cfg.Check != "" {
+		if err := cfg.useManifestHeader(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error checking manifest: %v\n", err)
+			os.Exit(exitFatal)
+		}
+	}
+
+	if err := cfg.resolve(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitFatal)
+	}
+	var err error
+	if logger, err = newLogger(os.Stderr, cfg.LogLevel, cfg.LogFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitFatal)
+	}
+
+	hf, err := cfg.hasher()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		os.Exit(exitFatal)
+	}
+
+	if cfg.Truncate > 0 {
+		warnTruncate(cfg)
+	}
+
+	if err := validateFormat(cfg.Format, cfg.SumStyle, cfg.HashTypes, cfg.Encoding); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitFatal)
+	}
+	if cfg.LineTmpl != "" {
+		if cfg.Format != formatText {
+			fmt.Fprintf(os.Stderr, "--output-template requires the %s format\n", formatText)
+			os.Exit(exitFatal)
+		}
+		if err := validateLineTemplate(cfg.LineTmpl); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitFatal)
+		}
+	}
+	if cfg.S3 != "" && (cfg.OutFile != "" || cfg.Append) {
+		fmt.Fprintln(os.Stderr, "--s3 cannot be used with --out-file or --append")
+		os.Exit(exitFatal)
+	}
+	if cfg.ShardDir != "" {
+		if cfg.OutFile != "" || cfg.S3 != "" || cfg.Append {
+			fmt.Fprintln(os.Stderr, "--shard-output cannot be used with --out-file, --s3 or --append")
+			os.Exit(exitFatal)
+		}
+		if cfg.ShardLen < 1 || cfg.ShardLen > maxShardLen {
+			fmt.Fprintf(os.Stderr, "--shard-prefix-len must be between 1 and %d\n", maxShardLen)
+			os.Exit(exitFatal)
+		}
+		if cfg.Encoding != hasher.EncodingHex || (cfg.Truncate > 0 && cfg.Truncate < cfg.ShardLen) {
+			fmt.Fprintf(os.Stderr, "--shard-output requires the %s encoding and digests not truncated below --shard-prefix-len\n", hasher.EncodingHex)
+			os.Exit(exitFatal)
+		}
+		if cfg.EmptyAs != "" || cfg.JSONErrors {
+			fmt.Fprintln(os.Stderr, "--shard-output cannot be used with --hash-empty-as or --json-errors")
+			os.Exit(exitFatal)
+		}
+	}
+	if cfg.Append && (cfg.OutFile == "" || cfg.Format == formatJSON) {
+		fmt.Fprintf(os.Stderr, "--append requires --out-file and a format other than %s\n", formatJSON)
+		os.Exit(exitFatal)
+	}
+	if cfg.length > 0 && (cfg.Archives || cfg.Cache != "") {
+		fmt.Fprintln(os.Stderr, "--length cannot be used with --archives or --cache")
+		os.Exit(exitFatal)
+	}
+	if cfg.tail > 0 && (cfg.length > 0 || cfg.Stdin || cfg.Archives || cfg.Cache != "") {
+		fmt.Fprintln(os.Stderr, "--tail-bytes cannot be used with --length, standard input, --archives or --cache")
+		os.Exit(exitFatal)
+	}
+	if cfg.remote && (cfg.Rename || cfg.Cache != "" || cfg.Compare != "" || cfg.DryRun || cfg.CountOnly || cfg.FilesFrom != "" || cfg.Fingerprint || cfg.Archives || cfg.Check != "" || cfg.tail > 0 || cfg.maxRate > 0) {
+		fmt.Fprintln(os.Stderr, "--rename, --cache, --compare, --dry-run, --count-only, --files-from, --fast-fingerprint, --archives, --check, --tail-bytes and --max-rate cannot be used with a URL as --path")
+		os.Exit(exitFatal)
+	}
+	if cfg.Fingerprint && (cfg.Stdin || cfg.Archives || cfg.length > 0 || cfg.tail > 0) {
+		fmt.Fprintln(os.Stderr, "--fast-fingerprint cannot be used with standard input, --archives, --length or --tail-bytes")
+		os.Exit(exitFatal)
+	}
+	if cfg.EmptyAs != "" && cfg.Format == formatCoreutils {
+		fmt.Fprintf(os.Stderr, "--hash-empty-as does not support the %s format\n", formatCoreutils)
+		os.Exit(exitFatal)
+	}
+	if cfg.Metadata && cfg.Format != formatJSON && cfg.Format != formatNDJSON && cfg.Webhook == "" {
+		fmt.Fprintf(os.Stderr, "--with-metadata requires the %s or %s format, or --webhook\n", formatJSON, formatNDJSON)
+		os.Exit(exitFatal)
+	}
+	if cfg.Webhook != "" && (cfg.HookBatch <= 0 || cfg.HookTimeout <= 0) {
+		fmt.Fprintln(os.Stderr, "--webhook-batch and --webhook-timeout must be positive")
+		os.Exit(exitFatal)
+	}
+	if cfg.RenameDir != "" {
+		if !cfg.Rename {
+			fmt.Fprintln(os.Stderr, "--rename-dir requires --rename")
+			os.Exit(exitFatal)
+		}
+		if within(cfg.RenameDir, pipeline.RootDir(cfg.Path)) {
+			fmt.Fprintln(os.Stderr, "--rename-dir cannot be within --path, whose walk would find the renamed files")
+			os.Exit(exitFatal)
+		}
+	}
+	if cfg.CopyTo != "" {
+		if cfg.Stdin || cfg.remote || cfg.Check != "" || cfg.Compare != "" || cfg.Cache != "" || cfg.Fingerprint || cfg.length > 0 || cfg.tail > 0 || cfg.Archives || cfg.Hardlinks || !cfg.LinkTarget {
+			fmt.Fprintln(os.Stderr, "--copy-to reads every file in full and cannot be used with standard input, a URL as --path, --check, --compare, --cache, --fast-fingerprint, --length, --tail-bytes, --archives, --hardlinks or --hash-symlink-target=false")
+			os.Exit(exitFatal)
+		}
+		if within(cfg.CopyTo, pipeline.RootDir(cfg.Path)) {
+			fmt.Fprintln(os.Stderr, "--copy-to cannot be within --path, whose walk would find the copies")
+			os.Exit(exitFatal)
+		}
+	}
+	if cfg.Archives && cfg.Rename {
+		fmt.Fprintln(os.Stderr, "--rename cannot be used with --archives")
+		os.Exit(exitFatal)
+	}
+	if cfg.aggregate() && cfg.Format == formatCoreutils {
+		fmt.Fprintf(os.Stderr, "--dedup and --tree-hash do not support the %s format\n", formatCoreutils)
+		os.Exit(exitFatal)
+	}
+
+	if err := cfg.pipelineOptions().Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitFatal)
+	}
+
+	// Interrupting or terminating the process cancels the pipeline: no new files are queued,
+	// the files being hashed are aborted, and the results computed so far are still written.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if cfg.Benchmark {
+		hashTypes := hasher.SupportedHashes()
+		if cfg.hashSet {
+			hashTypes = cfg.HashTypes
+		}
+		if err := runBenchmark(ctx, os.Stdout, hashTypes, cfg.benchSize); err != nil {
+			fmt.Fprintf(os.Stderr, "Error running benchmark: %v\n", err)
+			os.Exit(exitFatal)
+		}
+		return
+	}
+
+	if cfg.Check != "" {
+		ok, err := runCheck(ctx, cfg, hf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error checking manifest: %v\n", err)
+			os.Exit(exitFatal)
+		}
+		if !ok {
+			os.Exit(exitFileErrors)
+		}
+		return
+	}
+
+	if cfg.Compare != "" {
+		if cfg.Stdin {
+			fmt.Fprintln(os.Stderr, "--compare cannot be used when hashing standard input")
+			os.Exit(exitFatal)
+		}
+		ok, err := runCompare(ctx, cfg, hf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error comparing trees: %v\n", err)
+			os.Exit(exitFatal)
+		}
+		if !ok {
+			os.Exit(exitFileErrors)
+		}
+		return
+	}
+
+	if cfg.FilesFrom != "" {
+		if cfg.Stdin {
+			fmt.Fprintln(os.Stderr, "--files-from cannot be used when hashing standard input")
+			os.Exit(exitFatal)
+		}
+		files, err := readFileList(cfg.FilesFrom, cfg.Path, cfg.listNUL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading file list: %v\n", err)
+			os.Exit(exitFatal)
+		}
+		var local []string
+		for _, file := range files {
+			if isURL(file) {
+				cfg.urls = append(cfg.urls, file)
+			} else {
+				local = append(local, file)
+			}
+		}
+		if len(cfg.urls) > 0 && (cfg.tail > 0 || cfg.maxRate > 0) {
+			fmt.Fprintln(os.Stderr, "--tail-bytes and --max-rate cannot be used with URLs in --files-from")
+			os.Exit(exitFatal)
+		}
+		cfg.files = append(pipeline.Select(cfg.pipelineOptions(), local), cfg.urls...)
+	}
+
+	if cfg.DryRun && cfg.CountOnly {
+		fmt.Fprintln(os.Stderr, "--dry-run and --count-only cannot be used together")
+		os.Exit(exitFatal)
+	}
+	if cfg.CountOnly {
+		if cfg.Stdin {
+			fmt.Fprintln(os.Stderr, "--count-only cannot be used when hashing standard input")
+			os.Exit(exitFatal)
+		}
+		ok, err := countOnly(ctx, cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error walking path %s: %v\n", cfg.Path, err)
+			os.Exit(exitFatal)
+		}
+		if !ok {
+			os.Exit(exitFileErrors)
+		}
+		return
+	}
+	if cfg.DryRun {
+		if cfg.Stdin {
+			fmt.Fprintln(os.Stderr, "--dry-run cannot be used when hashing standard input")
+			os.Exit(exitFatal)
+		}
+		ok, err := dryRun(ctx, cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error walking path %s: %v\n", cfg.Path, err)
+			os.Exit(exitFatal)
+		}
+		if !ok {
+			os.Exit(exitFileErrors)
+		}
+		return
+	}
+
+	if cfg.NumWorkers == 0 && !cfg.Stdin && !cfg.remote {
+		if cfg.FilesFrom != "" {
+			cfg.NumWorkers = pipeline.WorkerCount(cfg.limitFiles(len(cfg.files)))
+		} else {
+			cfg.NumWorkers = pipeline.AutoWorkers(ctx, cfg.pipelineOptions())
+		}
+		logger.Debug("selected the number of workers", "workers", cfg.NumWorkers)
+	}
+
+	var prog *progress
+	if cfg.Progress {
+		prog = newProgress(os.Stderr)
+		hf = prog.wrap(hf)
+		if cfg.FilesFrom != "" {
+			prog.setTotal(cfg.limitFiles(len(cfg.files)))
+		} else if cfg.remote {
+			prog.setTotal(1)
+		} else if !cfg.Stdin && !cfg.Archives {
+			// The pre-scan runs alongside the hashing; a spinner is shown until the total is known.
+			// With --archives, each entry is a result of its own, so the total stays unknown.
+			go func() {
+				if total, err := pipeline.Count(ctx, cfg.pipelineOptions()); err == nil {
+					prog.setTotal(cfg.limitFiles(total))
+				}
+			}()
+		}
+		prog.run()
+	}
+
+	// The run has its own context so that --fail-fast can stop it without being reported as an interruption.
+	runCtx, cancelRun := context.WithCancel(ctx)
+	defer cancelRun()
+
+	if cfg.Cache != "" {
+		if cfg.Stdin {
+			fmt.Fprintln(os.Stderr, "--cache cannot be used when hashing standard input")
+			os.Exit(exitFatal)
+		}
+		if cfg.cache, err = loadCache(cfg.Cache, cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading cache: %v\n", err)
+			os.Exit(exitFatal)
+		}
+	}
+
+	started := time.Now()
+	if cfg.Header {
+		cfg.header = newManifestHeader(cfg, started)
+	}
+	var results <-chan pipeline.Result
+	if cfg.Stdin {
+		if cfg.Rename {
+			fmt.Fprintln(os.Stderr, "--rename cannot be used when hashing standard input")
+			os.Exit(exitFatal)
+		}
+		if cfg.aggregate() {
+			fmt.Fprintln(os.Stderr, "--dedup and --tree-hash cannot be used when hashing standard input")
+			os.Exit(exitFatal)
+		}
+		results = hashStdin(hf)
+	} else if cfg.remote {
+		results = hashURLs(runCtx, []string{cfg.Path}, hf, cfg.HTTPTimeout, cfg.length, 1)
+	} else if cfg.FilesFrom != "" {
+		// --max-files caps the local files and the URLs together, the local files coming first.
+		files := cfg.files[:cfg.limitFiles(len(cfg.files))]
+		local := files[:min(len(files), len(cfg.files)-len(cfg.urls))]
+		urls := files[len(local):]
+		results = pipeline.RunFiles(runCtx, cfg.pipelineOptions(), local, hf)
+		if len(urls) > 0 {
+			results = mergeResults(results, hashURLs(runCtx, urls, hf, cfg.HTTPTimeout, cfg.length, cfg.NumWorkers))
+		}
+	} else {
+		results = pipeline.Run(runCtx, cfg.pipelineOptions(), hf)
+	}
+
+	var db *sqliteStore
+	if cfg.SQLite != "" {
+		if db, err = openSQLite(cfg.SQLite, cfg, started); err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening database: %v\n", err)
+			os.Exit(exitFatal)
+		}
+	}
+
+	var hook *webhookSender
+	if cfg.Webhook != "" {
+		if hook, err = newWebhook(ctx, cfg, started); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitFatal)
+		}
+	}
+
+	var ren *renamer
+	if cfg.Rename {
+		if ren, err = newRenamer(cfg.Path, cfg.RenameDir, cfg.RenameTmpl, cfg.OnCollision); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitFatal)
+		}
+		defer func() { _ = ren.Close() }() // #nosec G104 -- the root is only used for renames, which report their own errors
+	}
+
+	stream, closeStream, err := openStream(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating output file: %v\n", err)
+		os.Exit(exitFatal)
 	}
 
-	results := pipeline.Run(cfg.Path, cfg.FilePattern, cfg.NumWorkers, hf)
+	output, errs, stats := processResults(results, cfg, stream, db, hook, ren, prog, cancelRun)
+	if prog != nil {
+		prog.stop()
+	}
 
-	output, errs := processResults(results, cfg)
+	status := 0
+	if runFailed(errs) {
+		status = exitFatal
+	} else if len(errs) > 0 {
+		status = exitFileErrors
+	}
 
-	if cfg.OutFile != "" {
-		if err := writeResultsToFile(cfg.OutFile, output); err != nil {
+	if stream != nil {
+		if err := closeStream(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+			status = exitFatal
+		}
+	} else if (cfg.OutFile != "" || cfg.S3 != "" || cfg.ShardDir != "") && cfg.Format == formatJSON {
+		if err := writeResultsToFile(output, errs, cfg); err != nil {
 			fmt.Fprintf(os.Stderr, "Error writing output file: %v\n", err)
+			status = exitFatal
+		}
+	} else if cfg.Display && cfg.Format == formatJSON && !cfg.aggregate() {
+		if err := writeJSON(os.Stdout, output, errs, cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+			status = exitFatal
+		}
+	}
+
+	if cfg.cache != nil {
+		if err := cfg.cache.save(cfg.Cache, cfg.cacheRoot(runCtx, errs)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing cache: %v\n", err)
+			status = exitFatal
+		}
+	}
+
+	if db != nil {
+		if err := db.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing database: %v\n", err)
+			status = exitFatal
+		}
+	}
+
+	if hook != nil {
+		if err := hook.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error posting to webhook: %v\n", err)
+			status = exitFatal
 		}
 	}
 
-	if len(errs) > 0 {
-		fmt.Fprintln(os.Stderr, "\nErrors encountered:")
-		for _, err := range errs {
-			fmt.Fprintln(os.Stderr, "-", err)
+	if cfg.Dedup && !cfg.Quiet {
+		if err := writeDuplicates(os.Stdout, findDuplicates(output, cfg), cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing duplicates: %v\n", err)
+			status = exitFatal
 		}
 	}
+
+	if cfg.TreeHash && !cfg.Quiet {
+		digest, err := treeHash(output, cfg)
+		if err == nil {
+			err = writeTreeHash(os.Stdout, digest, cfg)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing tree hash: %v\n", err)
+			status = exitFatal
+		}
+	}
+
+	logSummary(cfg, stats, time.Since(started))
+
+	if ctx.Err() != nil {
+		stop()
+		logger.Warn("interrupted", "completed", stats.Completed, "skipped", stats.Skipped)
+		if cfg.OutFile != "" && !cfg.Stdin && !cfg.remote {
+			if err := writeSidecars(cfg, stats.Done); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing the list of remaining files: %v\n", err)
+			} else {
+				logger.Info("listed the remaining files to resume the run with --files-from", "completed", cfg.OutFile+partialSuffix, "remaining", cfg.OutFile+remainingSuffix)
+			}
+		}
+		os.Exit(exitInterrupted)
+	}
+	if cfg.FailFast && len(errs) > 0 {
+		logger.Warn("stopped at the first error", "completed", stats.Completed, "skipped", stats.Skipped)
+	}
+	if status != 0 {
+		os.Exit(status)
+	}
+}
+
+// openStream returns the stream receiving the results as they arrive with every format but json:
+// the --shard-output shards, the output file, or standard output when the results are displayed. It returns a nil stream
+// when the results are not streamed. The close function flushes the results and finishes the
+// output file as described by openOutFile, and returns the first error encountered while writing.
+func openStream(cfg *Config) (*resultStream, func() error, error) {
+	if cfg.Format == formatJSON {
+		return nil, nil, nil
+	}
+	if cfg.ShardDir != "" {
+		shards, err := newShardSet(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		stream := &resultStream{shards: shards, cfg: cfg}
+		return stream, func() error { return shards.close(nil) }, nil
+	}
+	if cfg.OutFile == "" && cfg.S3 == "" {
+		if !cfg.Display || cfg.aggregate() {
+			return nil, nil, nil
+		}
+		stream := &resultStream{w: os.Stdout, cfg: cfg}
+		if cfg.header != nil {
+			stream.writeHeader(cfg.header)
+		}
+		return stream, func() error { return stream.err }, nil
+	}
+
+	// Appending to a manifest that already has content does not repeat its header.
+	header := cfg.header
+	if info, err := os.Stat(filepath.Clean(cfg.OutFile)); cfg.Append && err == nil && info.Size() > 0 {
+		header = nil
+	}
+	w, finish, err := openOutFile(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	bw := bufio.NewWriter(w)
+	stream := &resultStream{w: bw, cfg: cfg}
+	if header != nil {
+		stream.writeHeader(header)
+	}
+	return stream, func() error {
+		err := stream.err
+		if err == nil {
+			err = bw.Flush()
+		}
+		return finish(err)
+	}, nil
+}
+
+// openOutFile opens the output file of a stream, or the object it is uploaded to with --s3.
+// With --append, the results are appended to the file, created if needed, and synced to disk
+// when finished. Otherwise the file is replaced atomically when finished, unless writing
+// failed. finish returns the first error.
+func openOutFile(cfg *Config) (w io.Writer, finish func(error) error, err error) {
+	if cfg.S3 != "" {
+		u, err := openS3(context.Background(), cfg.S3, cfg.contentType())
+		if err != nil {
+			return nil, nil, err
+		}
+		return u, u.finish, nil
+	}
+	name := filepath.Clean(cfg.OutFile)
+	if cfg.Append {
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644) // #nosec G302 -- manifests are shared like those of os.Create
+		if err != nil {
+			return nil, nil, err
+		}
+		return file, func(err error) error {
+			if err == nil {
+				err = file.Sync()
+			}
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			return err
+		}, nil
+	}
+	file, err := createAtomic(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, func(err error) error {
+		if err != nil {
+			file.Abort()
+			return err
+		}
+		return file.Commit()
+	}, nil
 }
 
 // parseFlags defines and parses CLI flags into a Config struct.
 // It sets defaults for hash types, worker counts, and patterns.
 func parseFlags() *Config {
 	cfg := &Config{}
-	flag.StringVar(&cfg.FilePattern, "file-pattern", "*", "File pattern to search")
-	flag.StringVar(&cfg.Path, "path", ".", "Directory to search")
-	flag.StringVar(&cfg.HashType, "hash", hasher.HashMD5, "Hash type: MD5, SHA1, SHA256, XXH3-128, HIGHWAYHASH, WYHASH, BLAKE3")
+	flag.StringVar(&cfg.FilePattern, "file-pattern", "*", "File pattern to search, or comma-separated list of patterns; braces expand as in *.{jpg,png}")
+	flag.BoolVar(&cfg.IgnoreCase, "ignore-case", false, "Match --file-pattern and --exclude regardless of case, so that *.jpg also selects PHOTO.JPG")
+	flag.BoolVar(&cfg.MatchPath, "match-path", false, "Match --file-pattern against the slash-separated path relative to --path instead of the name")
+	flag.StringVar(&cfg.Regex, "regex", "", "Regular expression matched against file names, replacing --file-pattern")
+	flag.BoolVar(&cfg.RegexFull, "regex-full", false, "Match --regex against the slash-separated path relative to --path instead of the name")
+	flag.StringVar(&cfg.MinSize, "min-size", "", "Skip files smaller than this size (e.g. 100MB, 2GiB)")
+	flag.StringVar(&cfg.MaxSize, "max-size", "", "Skip files larger than this size (e.g. 100MB, 2GiB)")
+	flag.StringVar(&cfg.ModAfter, "modified-after", "", "Skip files modified before this RFC3339 time or duration ago (e.g. 24h, 7d)")
+	flag.StringVar(&cfg.ModBefore, "modified-before", "", "Skip files modified after this RFC3339 time or duration ago (e.g. 24h, 7d)")
+	flag.StringVar(&cfg.NewerThan, "newer-than-manifest", "", "Skip files modified before this manifest was generated, read from its header or its modification time")
+	flag.IntVar(&cfg.MaxFiles, "max-files", 0, "Hash at most this many files, such as for a quick sample of a large tree (0 for unlimited)")
+	flag.IntVar(&cfg.MaxDepth, "max-depth", -1, "Maximum directory depth to descend, 0 searching only the direct children of --path (-1 for unlimited)")
+	flag.BoolVar(&cfg.Follow, "follow-symlinks", false, "Descend into symbolic links to directories (links must stay within --path)")
+	flag.BoolVar(&cfg.LinkTarget, "hash-symlink-target", true, "Hash the contents symbolic links point to; false hashes their target path instead, marking them in the output")
+	flag.BoolVar(&cfg.SkipHidden, "skip-hidden", false, "Skip files and directories whose name starts with a dot")
+	flag.BoolVar(&cfg.Metadata, "with-metadata", false, "Record the mode, owner IDs and modification time of each file in the json and ndjson output")
+	flag.BoolVar(&cfg.Restat, "restat", false, "Stat each file again once hashed and warn about the files whose size or modification time changed during the read")
+	flag.BoolVar(&cfg.Hardlinks, "hardlinks", false, "Hash files with several hard links once, reusing their digests for the other paths (Unix only)")
+	flag.BoolVar(&cfg.SkipEmpty, "skip-empty", false, "Skip empty files, which all share the same digest")
+	flag.StringVar(&cfg.EmptyAs, "hash-empty-as", "", "Write this marker (e.g. EMPTY) instead of the digests of empty files, so that they stand out")
+	flag.BoolVar(&cfg.GitIgnore, "gitignore", false, "Skip files and directories matched by the .gitignore files of the searched directories")
+	flag.Var(&cfg.Excludes, "exclude", "Glob pattern of files or directories to skip, matched against the name and the relative path (repeatable or comma-separated)")
+	flag.StringVar(&cfg.Path, "path", ".", "Directory to search, file to hash, or - to hash standard input")
+	flag.StringVar(&cfg.FilesFrom, "files-from", "", "File listing the paths to hash, one per line, instead of searching --path (- for standard input)")
+	flag.StringVar(&cfg.FilesFrom0, "files-from0", "", "Like --files-from, with the paths separated by NUL bytes as written by find -print0")
+	flag.StringVar(&cfg.HashType, "hash", hasher.HashMD5, "Hash type (case-insensitive), or comma-separated list of hash types computed in a single pass: "+strings.Join(hasher.SupportedHashes(), ", "))
+	flag.BoolVar(&cfg.Uppercase, "uppercase", false, "Write hex digests in uppercase")
+	flag.IntVar(&cfg.Truncate, "truncate", 0, "Write only the first N characters of each encoded digest, like abbreviated git hashes (0 for the full digest)")
+	flag.StringVar(&cfg.Blake3Key, "blake3-key", "", "Compute BLAKE3 digests in keyed mode with this 32-byte key written as 64 hex digits, or @file to read it from a file")
+	flag.StringVar(&cfg.Blake3Ctx, "blake3-derive-context", "", "Compute BLAKE3 digests in key derivation mode with this context string, such as for domain-separated IDs")
+	flag.IntVar(&cfg.Blake3Len, "blake3-length", hasher.Blake3Size, "Length in bytes of the BLAKE3 digests, read from its extendable output, such as 64 for extra collision margin")
+	flag.StringVar(&cfg.HMACKey, "hmac-key", "", "Compute HMAC-<hash> digests with this secret key, or @file to read the key from a file")
+	flag.StringVar(&cfg.Encoding, "encoding", hasher.EncodingHex, "Digest encoding: hex, base64, base64url, base32")
 	flag.StringVar(&cfg.OutFile, "out-file", "", "File to store the results")
+	flag.StringVar(&cfg.ShardDir, "shard-output", "", "Directory to split the results into, one file per digest prefix such as 00.txt to ff.txt, instead of --out-file")
+	flag.IntVar(&cfg.ShardLen, "shard-prefix-len", 2, "Number of hex digits of the digests naming the --shard-output files, from 1 to 3")
+	flag.StringVar(&cfg.S3, "s3", "", "S3 object to upload the results to, as s3://bucket/key, instead of --out-file")
+	flag.BoolVar(&cfg.Append, "append", false, "Append the results to --out-file instead of replacing it (not supported with the json format)")
+	flag.StringVar(&cfg.SQLite, "sqlite", "", "SQLite database to insert the results into, created if needed")
+	flag.StringVar(&cfg.Webhook, "webhook", "", "URL to POST the results to as JSON batches while they complete")
+	flag.IntVar(&cfg.HookBatch, "webhook-batch", 100, "Number of result records per --webhook request")
+	flag.DurationVar(&cfg.HookTimeout, "webhook-timeout", 10*time.Second, "Timeout of each --webhook request, retried on network errors and 5xx statuses")
+	flag.StringVar(&cfg.Cache, "cache", "", "Cache file of the digests of a previous run, reused for the files whose size and modification time are unchanged, and updated after the run")
+	flag.StringVar(&cfg.Format, "format", formatText, "Output format: text, json, ndjson, coreutils")
+	flag.StringVar(&cfg.SumStyle, "checksum-style", checksumStyleGNU, "Layout of the coreutils format: gnu (hash  path) or bsd (TYPE (path) = hash)")
+	flag.StringVar(&cfg.LineTmpl, "output-template", "", "Layout of the text format lines, using the {path}, {hash}, {algo} and {size} placeholders")
+	flag.StringVar(&cfg.PathStyle, "path-style", pathStyleRelative, "Paths written to the output: relative (to --path) or absolute")
+	flag.BoolVar(&cfg.Header, "header", false, "Start the output with a header recording the version, time, algorithms, host and root of the run")
+	flag.BoolVar(&cfg.JSONErrors, "json-errors", false, "Include errors as records in JSON output")
+	flag.StringVar(&cfg.Check, "check", "", "Verify the files listed in a manifest (text or coreutils format, in the gnu or bsd style) instead of generating one")
+	flag.StringVar(&cfg.Compare, "compare", "", "Compare the files of --path with those of this directory and report the added, removed and changed files")
+	flag.BoolVar(&cfg.Stdin, "stdin", false, "Hash standard input instead of searching a directory")
+	flag.DurationVar(&cfg.HTTPTimeout, "http-timeout", 5*time.Minute, "Time limit of each download of an http(s) URL given as --path or listed by --files-from, 0 for none")
+	flag.BoolVar(&cfg.Progress, "progress", false, "Periodically report files processed, bytes hashed and throughput to stderr")
+	flag.BoolVar(&cfg.DryRun, "dry-run", false, "List the files selected by the filters without hashing them")
+	flag.BoolVar(&cfg.CountOnly, "count-only", false, "Print the number and total size of the files selected by the filters without hashing them")
+	flag.BoolVar(&cfg.Dedup, "dedup", false, "Report groups of files sharing the same digest instead of every hash")
+	flag.BoolVar(&cfg.TreeHash, "tree-hash", false, "Print a single digest of the whole tree, combining the sorted paths and digests of all files")
+	flag.BoolVar(&cfg.FailFast, "fail-fast", false, "Stop at the first file error and exit with a non-zero status")
+	flag.BoolVar(&cfg.SkipErrors, "skip-errors", false, "Report the directories that cannot be read as warnings instead of errors, without a non-zero exit status")
 	flag.BoolVar(&cfg.Rename, "rename", false, "Rename files to their hash value")
+	flag.StringVar(&cfg.OnCollision, "on-collision", collisionError, "Behavior of --rename when the destination exists: error, skip, overwrite")
+	flag.StringVar(&cfg.RenameDir, "rename-dir", "", "Directory to move renamed files into, created if needed, instead of renaming them within --path")
+	flag.StringVar(&cfg.CopyTo, "copy-to", "", "Directory to copy each file to while it is hashed, at the same path relative to it as to --path, reading the file once for both")
+	flag.StringVar(&cfg.RenameTmpl, "rename-template", defaultRenameTemplate, "Destination of --rename relative to --path, with the placeholders {hash}, {hash:N}, {name}, {ext} and {dir}")
 	flag.BoolVar(&cfg.Display, "display", true, "Display hash values to the user")
+	flag.BoolVar(&cfg.Quiet, "quiet", false, "Suppress all output except errors, including the progress and the summary")
+	flag.BoolVar(&cfg.Verbose, "verbose", false, "Log the size, duration and throughput of every file to stderr, as --log-level=debug")
+	flag.StringVar(&cfg.LogLevel, "log-level", "info", "Minimum level of the diagnostics logged to stderr: debug, info, warn, error (default error with --quiet, debug with --verbose)")
+	flag.StringVar(&cfg.LogFormat, "log-format", logFormatText, "Format of the diagnostics logged to stderr: text (key=value) or json")
 	flag.BoolVar(&cfg.Version, "version", false, "Display version information")
-	flag.IntVar(&cfg.NumWorkers, "workers", runtime.NumCPU(), "Number of worker goroutines")
+	flag.BoolVar(&cfg.ListHashes, "list-hashes", false, "List the supported hash types, one per line, and exit")
+	flag.BoolVar(&cfg.Benchmark, "benchmark", false, "Measure the throughput of each hash type, or of the --hash types, on an in-memory buffer and exit")
+	flag.StringVar(&cfg.BenchSize, "benchmark-size", defaultBenchmarkSize, "Size of the buffer hashed by --benchmark")
+	flag.StringVar(&cfg.Workers, "workers", strconv.Itoa(runtime.NumCPU()), "Number of worker goroutines, or auto to use at most one per file")
+	flag.StringVar(&cfg.MaxRate, "max-rate", "", "Maximum total read throughput of all workers (e.g. 50MB/s)")
+	flag.IntVar(&cfg.IOLimit, "io-concurrency", 0, "Maximum number of files read simultaneously, independent of --workers (0 for unlimited)")
+	flag.BoolVar(&cfg.Archives, "archives", false, "Hash the files stored in .zip, .tar, .tar.gz and .tgz archives entry by entry")
+	flag.BoolVar(&cfg.Mmap, "mmap", false, "Memory-map large files instead of streaming them (Unix only)")
+	flag.StringVar(&cfg.MmapMin, "mmap-threshold", "64MiB", "Minimum file size to memory-map with --mmap")
+	flag.StringVar(&cfg.BufferSize, "buffer-size", "0", "Read buffer size per worker (e.g. 1MiB) to reduce read system calls on slow storage, 0 to disable")
+	flag.StringVar(&cfg.Length, "length", "", "Hash at most this many bytes of each file (e.g. 1GiB), such as to cap the read of a device")
+	flag.StringVar(&cfg.Length, "head-bytes", "", "Alias of --length: hash only the first bytes of each file, as a cheap change indicator")
+	flag.StringVar(&cfg.Tail, "tail-bytes", "", "Hash only the last bytes of each file (e.g. 1MiB), as a cheap change indicator of files that grow")
+	flag.BoolVar(&cfg.Fingerprint, "fast-fingerprint", false, "Hash the size, modification time, device and inode of each file instead of its contents, marked as FINGERPRINT- digests")
+	flag.StringVar(&cfg.ConfigFile, "config", "", "YAML or JSON file of default flag values, keyed by flag name; the command line takes precedence")
 	flag.Parse()
+	if err := applyEnvironment(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading environment: %v\n", err)
+		os.Exit(exitFatal)
+	}
+	if cfg.ConfigFile != "" {
+		if err := applyConfigFile(cfg.ConfigFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading config file: %v\n", err)
+			os.Exit(exitFatal)
+		}
+	}
+	cfg.HashTypes = parseHashTypes(cfg.HashType)
+	logLevelSet := false
+	// --check defaults to the hash type, encoding, truncation and BLAKE3 length of the manifest header, unless they are given.
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "hash":
+			cfg.hashSet = true
+		case "encoding":
+			cfg.encodingSet = true
+		case "truncate":
+			cfg.truncateSet = true
+		case "blake3-length":
+			cfg.b3LenSet = true
+		case "log-level":
+			logLevelSet = true
+		}
+	})
+	if cfg.Quiet {
+		cfg.Display = false
+		cfg.Progress = false
+		cfg.Verbose = false
+	}
+	if !logLevelSet {
+		switch {
+		case cfg.Quiet:
+			cfg.LogLevel = "error"
+		case cfg.Verbose:
+			cfg.LogLevel = "debug"
+		}
+	}
+	// A trailing "-" argument requests standard input, as with coreutils tools.
+	if cfg.Path == stdinPath || (flag.NArg() == 1 && flag.Arg(0) == stdinPath) {
+		cfg.Stdin = true
+	}
+	cfg.remote = isURL(cfg.Path)
 	return cfg
 }
 
-// processResults iterates over the results channel and handles renaming or display.
-// It aggregates results for potential file output and collects any errors.
-func processResults(results <-chan pipeline.Result, cfg *Config) (map[string]string, []error) {
-	output := make(map[string]string)
-	var errs []error
+// resolve parses the flag values that need conversion, such as the regular expression,
+// the sizes and the modification time window.
+func (cfg *Config) resolve() error {
+	var err error
+	if cfg.Regex != "" {
+		if cfg.regex, err = regexp.Compile(cfg.Regex); err != nil {
+			return fmt.Errorf("invalid --regex: %w", err)
+		}
+	}
+	if cfg.minSize, err = parseSize(cfg.MinSize); err != nil {
+		return fmt.Errorf("invalid --min-size: %w", err)
+	}
+	if cfg.maxSize, err = parseSize(cfg.MaxSize); err != nil {
+		return fmt.Errorf("invalid --max-size: %w", err)
+	}
+	if cfg.length, err = parseSize(cfg.Length); err != nil {
+		return fmt.Errorf("invalid --length: %w", err)
+	}
+	if cfg.tail, err = parseSize(cfg.Tail); err != nil {
+		return fmt.Errorf("invalid --tail-bytes: %w", err)
+	}
+	if cfg.bufferSize, err = parseSize(cfg.BufferSize); err != nil {
+		return fmt.Errorf("invalid --buffer-size: %w", err)
+	}
+	if cfg.mmapMin, err = parseSize(cfg.MmapMin); err != nil {
+		return fmt.Errorf("invalid --mmap-threshold: %w", err)
+	}
+	if cfg.FilesFrom0 != "" {
+		if cfg.FilesFrom != "" {
+			return errors.New("--files-from and --files-from0 cannot be used together")
+		}
+		cfg.FilesFrom, cfg.listNUL = cfg.FilesFrom0, true
+	}
+	switch cfg.PathStyle {
+	case pathStyleRelative, pathStyleAbsolute:
+	default:
+		return fmt.Errorf("unsupported path style: %s", cfg.PathStyle)
+	}
+	// The root of the relative paths, which absolute paths are resolved against.
+	if cfg.absRoot, err = filepath.Abs(pipeline.RootDir(cfg.Path)); err != nil {
+		return err
+	}
+	if cfg.NumWorkers, err = parseWorkers(cfg.Workers); err != nil {
+		return fmt.Errorf("invalid --workers: %w", err)
+	}
+	if cfg.benchSize, err = parseSize(cfg.BenchSize); err != nil || (cfg.Benchmark && cfg.benchSize == 0) {
+		if err == nil {
+			err = errors.New("the size must be positive")
+		}
+		return fmt.Errorf("invalid --benchmark-size: %w", err)
+	}
+	if cfg.maxRate, err = parseRate(cfg.MaxRate); err != nil {
+		return fmt.Errorf("invalid --max-rate: %w", err)
+	}
+	// Hash types are shown and matched by their canonical name, whatever the spelling given.
+	for i, hashType := range cfg.HashTypes {
+		if cfg.HashTypes[i], err = hasher.CanonicalType(hashType); err != nil {
+			return err
+		}
+	}
+	if cfg.encoding, err = hasher.GetEncoding(cfg.Encoding); err != nil {
+		return err
+	}
+	if cfg.Uppercase {
+		if cfg.Encoding != hasher.EncodingHex {
+			return fmt.Errorf("--uppercase requires the %s encoding", hasher.EncodingHex)
+		}
+		encode := cfg.encoding
+		cfg.encoding = func(digest []byte) string { return strings.ToUpper(encode(digest)) }
+	}
+	if cfg.Truncate < 0 {
+		return fmt.Errorf("invalid --truncate: %d is negative", cfg.Truncate)
+	}
+	if cfg.Truncate > 0 {
+		encode, n := cfg.encoding, cfg.Truncate
+		cfg.encoding = func(digest []byte) string {
+			s := encode(digest)
+			if len(s) > n {
+				return s[:n]
+			}
+			return s
+		}
+	}
+	if cfg.hmacKey, err = loadKey(cfg.HMACKey); err != nil {
+		return fmt.Errorf("invalid --hmac-key: %w", err)
+	}
+	if cfg.Blake3Len <= 0 {
+		return fmt.Errorf("invalid --blake3-length: %d is not positive", cfg.Blake3Len)
+	}
+	if cfg.Blake3Len != hasher.Blake3Size && !slices.ContainsFunc(cfg.HashTypes, isBlake3) {
+		return fmt.Errorf("--blake3-length requires the %s hash type", hasher.HashBlake3)
+	}
+	if cfg.Blake3Key != "" || cfg.Blake3Ctx != "" {
+		if !slices.ContainsFunc(cfg.HashTypes, isBlake3) {
+			return fmt.Errorf("--blake3-key and --blake3-derive-context require the %s hash type", hasher.HashBlake3)
+		}
+		key, err := loadKey(cfg.Blake3Key)
+		if err != nil {
+			return fmt.Errorf("invalid --blake3-key: %w", err)
+		}
+		if key != nil {
+			if cfg.blake3Key, err = hex.DecodeString(string(key)); err != nil || len(cfg.blake3Key) != hasher.Blake3KeySize {
+				return fmt.Errorf("invalid --blake3-key: expected %d hex digits", 2*hasher.Blake3KeySize)
+			}
+		}
+	}
+	now := time.Now()
+	if cfg.modAfter, err = parseTimeBound(cfg.ModAfter, now); err != nil {
+		return fmt.Errorf("invalid --modified-after: %w", err)
+	}
+	if cfg.modBefore, err = parseTimeBound(cfg.ModBefore, now); err != nil {
+		return fmt.Errorf("invalid --modified-before: %w", err)
+	}
+	if cfg.NewerThan != "" {
+		since, err := manifestTime(cfg.NewerThan)
+		if err != nil {
+			return fmt.Errorf("invalid --newer-than-manifest: %w", err)
+		}
+		// The later of the bounds applies when --modified-after is given as well.
+		if since.After(cfg.modAfter) {
+			cfg.modAfter = since
+		}
+	}
+	return nil
+}
 
-	for result := range results {
-		if result.Error != nil {
-			errs = append(errs, fmt.Errorf("error processing file %s: %w", result.FilePath, result.Error))
-			continue
+// hasher returns the hash function computing the configured hash types in the configured
+// encoding, keyed with the HMAC key when one is set, and BLAKE3 in the selected mode.
+func (cfg *Config) hasher() (hasher.MultiFunc, error) {
+	return hasher.NewMultiHasher(cfg.HashTypes, cfg.hasherOptions(cfg.encoding))
+}
+
+// hasherOptions returns the options of the hash functions rendering the digests with encode.
+func (cfg *Config) hasherOptions(encode hasher.Encoding) hasher.Options {
+	return hasher.Options{Key: cfg.hmacKey, Blake3Key: cfg.blake3Key, Blake3Context: cfg.Blake3Ctx, Blake3Length: cfg.blake3Length(), Encoding: encode}
+}
+
+// blake3Length returns the --blake3-length of the digests, or 0 for the default length, which
+// needs no extendable output.
+func (cfg *Config) blake3Length() int {
+	if cfg.Blake3Len == hasher.Blake3Size {
+		return 0
+	}
+	return cfg.Blake3Len
+}
+
+// isBlake3 reports whether a hash type names BLAKE3, in any spelling.
+func isBlake3(hashType string) bool {
+	name, err := hasher.CanonicalType(hashType)
+	return err == nil && name == hasher.HashBlake3
+}
+
+// warnTruncate warns about the hash types whose encoded digests are not longer than --truncate,
+// which are then written in full.
+func warnTruncate(cfg *Config) {
+	encode, err := hasher.GetEncoding(cfg.Encoding)
+	if err != nil {
+		return
+	}
+	hf, err := hasher.NewMultiHasher(cfg.HashTypes, cfg.hasherOptions(encode))
+	if err != nil {
+		return
+	}
+	digests, err := hf(strings.NewReader(""))
+	if err != nil {
+		return
+	}
+	for _, hashType := range cfg.HashTypes {
+		if n := len(digests[hashType]); cfg.Truncate > n {
+			logger.Warn("--truncate is larger than the digests, which are written in full", "truncate", cfg.Truncate, "algorithm", cfg.algorithm(hashType), "length", n)
 		}
+	}
+}
 
-		output[result.FilePath] = result.Hash
+// algorithm returns the name of the digest computed for a hash type, as shown in the output.
+// The BLAKE3 keyed and key derivation modes are prefixed with KEYED- and DERIVED-, and metadata
+// fingerprints with FINGERPRINT- so that they are never mistaken for content digests.
+func (cfg *Config) algorithm(hashType string) string {
+	if cfg.hmacKey != nil {
+		hashType = "HMAC-" + hashType
+	}
+	if cfg.blake3Key != nil && isBlake3(hashType) {
+		hashType = "KEYED-" + hashType
+	}
+	if cfg.Blake3Ctx != "" && isBlake3(hashType) {
+		hashType = "DERIVED-" + hashType
+	}
+	if cfg.Fingerprint {
+		hashType = "FINGERPRINT-" + hashType
+	}
+	return hashType
+}
 
-		if cfg.Rename {
-			newPath := filepath.Join(filepath.Dir(result.FilePath), result.Hash+filepath.Ext(result.FilePath))
-			if _, err := os.Stat(newPath); err == nil {
-				errs = append(errs, fmt.Errorf("could not rename %s to %s: file already exists", result.FilePath, newPath))
+// outputPath returns the path of a file as written to the output: relative to --path, or
+// absolute with --path-style=absolute. The name of standard input and URLs are left as is.
+func (cfg *Config) outputPath(rel string) string {
+	if cfg.PathStyle != pathStyleAbsolute || cfg.Stdin || isURL(rel) {
+		return rel
+	}
+	return filepath.Join(cfg.absRoot, rel)
+}
+
+// aggregate reports whether the run prints a report combining all results,
+// such as the duplicate groups or the tree hash, instead of every file digest.
+func (cfg *Config) aggregate() bool {
+	return cfg.Dedup || cfg.TreeHash
+}
+
+// loadKey returns the secret key given on the command line, or read from a file
+// when the value starts with "@". Trailing line breaks of a key file are removed.
+// An empty value returns a nil key.
+func loadKey(value string) ([]byte, error) {
+	name, ok := strings.CutPrefix(value, "@")
+	if !ok {
+		if value == "" {
+			return nil, nil
+		}
+		return []byte(value), nil
+	}
+	key, err := os.ReadFile(filepath.Clean(name))
+	if err != nil {
+		return nil, err
+	}
+	key = bytes.TrimRight(key, "\r\n")
+	if len(key) == 0 {
+		return nil, fmt.Errorf("key file %s is empty", name)
+	}
+	return key, nil
+}
+
+// pipelineOptions maps the configuration to the pipeline options.
+func (cfg *Config) pipelineOptions() pipeline.Options {
+	opts := pipeline.Options{
+		Path:            cfg.Path,
+		FilePatterns:    parsePatterns(cfg.FilePattern),
+		PatternFullPath: cfg.MatchPath,
+		IgnoreCase:      cfg.IgnoreCase,
+		Regex:           cfg.regex,
+		RegexFullPath:   cfg.RegexFull,
+		Excludes:        parsePatterns(cfg.Excludes...),
+		MinSize:         cfg.minSize,
+		MaxSize:         cfg.maxSize,
+		ModifiedAfter:   cfg.modAfter,
+		ModifiedBefore:  cfg.modBefore,
+		MaxDepth:        cfg.MaxDepth + 1, // The CLI counts levels below the root from 0, the pipeline from 1.
+		FollowSymlinks:  cfg.Follow,
+		SymlinkPaths:    !cfg.LinkTarget,
+		SkipHidden:      cfg.SkipHidden,
+		SkipEmpty:       cfg.SkipEmpty,
+		Hardlinks:       cfg.Hardlinks,
+		Metadata:        cfg.Metadata,
+		Restat:          cfg.Restat,
+		GitIgnore:       cfg.GitIgnore,
+		NumWorkers:      cfg.NumWorkers,
+		IOConcurrency:   cfg.IOLimit,
+		MaxRate:         cfg.maxRate,
+		BufferSize:      int(cfg.bufferSize),
+		Archives:        cfg.Archives,
+		Mmap:            cfg.Mmap,
+		MmapThreshold:   cfg.mmapMin,
+		Length:          cfg.length,
+		Tail:            cfg.tail,
+		Fingerprint:     cfg.Fingerprint,
+		MaxFiles:        cfg.MaxFiles,
+		CopyTo:          cfg.CopyTo,
+	}
+	if cfg.cache != nil {
+		opts.Reuse = cfg.cache.reuse
+	}
+	return opts
+}
+
+// stringList is a flag.Value collecting a repeatable, comma-separated list of strings.
+type stringList []string
+
+// String returns the values joined by commas.
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set appends the comma-separated values, ignoring surrounding whitespace and empty entries.
+// Commas within braces do not separate values, so that brace expressions are kept whole.
+func (l *stringList) Set(value string) error {
+	*l = append(*l, splitList(value)...)
+	return nil
+}
+
+// hashStdin hashes standard input as a single stream, bypassing the directory walk.
+// The result is reported under the conventional "-" name.
+func hashStdin(hf hasher.MultiFunc) <-chan pipeline.Result {
+	results := make(chan pipeline.Result, 1)
+	var size atomic.Int64
+	begin := time.Now()
+	hashes, err := hf(&countingReader{r: os.Stdin, n: &size})
+	results <- pipeline.Result{FilePath: stdinPath, Hashes: hashes, Size: size.Load(), Duration: time.Since(begin), Error: err}
+	close(results)
+	return results
+}
+
+// markEmpty returns digests of the same hash types as hashes, all set to the marker.
+func markEmpty(hashes map[string]string, marker string) map[string]string {
+	marked := make(map[string]string, len(hashes))
+	for hashType := range hashes {
+		marked[hashType] = marker
+	}
+	return marked
+}
+
+// logTiming logs the size, hashing duration and throughput of a file at the debug level, in
+// decimal megabytes per second. Files reused from the cache or from another hard link were not
+// read, so only their size is logged.
+func logTiming(result pipeline.Result) {
+	if result.Reused {
+		logger.Debug("reused file from the cache", "path", result.FilePath, "size", result.Size)
+		return
+	}
+	if result.Alias != "" {
+		logger.Debug("reused digest of hard link", "path", result.FilePath, "alias", result.Alias, "size", result.Size)
+		return
+	}
+	throughput := 0.0
+	if seconds := result.Duration.Seconds(); seconds > 0 {
+		throughput = float64(result.Size) / 1e6 / seconds
+	}
+	logger.Debug("hashed file", "path", result.FilePath, "size", result.Size, "seconds", result.Duration.Seconds(), "mb_per_s", math.Round(throughput*10)/10)
+}
+
+// logSummary logs the outcome of a run at the info level, as a sentence along with the counts
+// as attributes. The cache and failure counts are only included when relevant.
+func logSummary(cfg *Config, stats runStats, elapsed time.Duration) {
+	elapsed = elapsed.Round(time.Millisecond)
+	msg := fmt.Sprintf("Hashed %d files, %s in %s", stats.Completed, formatBytes(stats.Bytes), elapsed)
+	if cfg.Fingerprint {
+		msg = fmt.Sprintf("Fingerprinted the metadata of %d files in %s", stats.Completed, elapsed)
+	}
+	attrs := []any{"files", stats.Completed, "bytes", stats.Bytes, "seconds", elapsed.Seconds()}
+	if cfg.cache != nil {
+		msg += fmt.Sprintf(", %d unchanged files reused from the cache", stats.Reused)
+		attrs = append(attrs, "reused", stats.Reused)
+	}
+	if stats.Failed > 0 {
+		msg += fmt.Sprintf(", %d files failed", stats.Failed)
+		attrs = append(attrs, "failed", stats.Failed)
+	}
+	if stats.Unreadable > 0 {
+		msg += fmt.Sprintf(", %d unreadable directories skipped", stats.Unreadable)
+		attrs = append(attrs, "unreadable", stats.Unreadable)
+	}
+	if stats.Changed > 0 {
+		msg += fmt.Sprintf(", %d files modified while hashed", stats.Changed)
+		attrs = append(attrs, "changed", stats.Changed)
+	}
+	logger.Info(msg, attrs...)
+}
+
+// dryRun prints the files selected by the filters, one per line, without hashing them.
+// Errors on individual entries are printed to stderr as they are encountered.
+// It returns false if any entry could not be listed.
+func dryRun(ctx context.Context, cfg *Config) (bool, error) {
+	if cfg.FilesFrom != "" {
+		for _, filePath := range cfg.files {
+			fmt.Println(filePath)
+		}
+		logger.Info("matched files", "files", len(cfg.files))
+		return true, nil
+	}
+	n, failed := 0, 0
+	err := pipeline.List(ctx, cfg.pipelineOptions(), func(result pipeline.Result) {
+		if result.Error != nil {
+			logError(slog.LevelError, &fileError{Op: "listing", Path: result.FilePath, Err: result.Error})
+			failed++
+			return
+		}
+		fmt.Println(result.FilePath)
+		n++
+	})
+	if err != nil {
+		return false, err
+	}
+	logger.Info("matched files", "files", n)
+	return failed == 0, nil
+}
+
+// countOnly prints the number of files selected by the filters and their total size, from their
+// attributes alone: no file is read. URLs listed by --files-from are counted without their size,
+// which is only known once downloaded. It reports whether every file could be examined.
+func countOnly(ctx context.Context, cfg *Config) (bool, error) {
+	n, failed, size := 0, 0, int64(0)
+	count := func(result pipeline.Result) {
+		if result.Error != nil {
+			logError(slog.LevelError, &fileError{Op: "listing", Path: result.FilePath, Err: result.Error})
+			failed++
+			return
+		}
+		n++
+		size += result.Size
+	}
+	if cfg.FilesFrom != "" {
+		for _, filePath := range cfg.files {
+			if isURL(filePath) {
+				count(pipeline.Result{FilePath: filePath})
 				continue
 			}
-			if err := os.Rename(result.FilePath, newPath); err != nil {
-				errs = append(errs, fmt.Errorf("error renaming file %s: %w", result.FilePath, err))
+			info, err := os.Stat(filepath.Join(cfg.Path, filePath))
+			if err != nil {
+				count(pipeline.Result{FilePath: filePath, Error: err})
+				continue
 			}
+			count(pipeline.Result{FilePath: filePath, Size: info.Size()})
 		}
+	} else if err := pipeline.List(ctx, cfg.pipelineOptions(), count); err != nil {
+		return false, err
+	}
+	fmt.Printf("%d files, %s (%d bytes)\n", n, formatBytes(size), size)
+	return failed == 0, nil
+}
+
+// limitFiles returns the number of files hashed out of n selected files, capped by --max-files.
+func (cfg *Config) limitFiles(n int) int {
+	if cfg.MaxFiles > 0 {
+		return min(n, cfg.MaxFiles)
+	}
+	return n
+}
+
+// parseWorkers parses the --workers value: a positive number, or "auto" which returns 0
+// so that the count is picked from the files to hash.
+func parseWorkers(value string) (int, error) {
+	if value == "auto" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is neither a positive number nor auto", value)
+	}
+	return n, nil
+}
 
-		if cfg.Display && cfg.OutFile == "" {
-			fmt.Printf("%s: %s\n", result.FilePath, result.Hash)
+// parseHashTypes splits a comma-separated list of hash types.
+// Surrounding whitespace and empty entries are ignored.
+func parseHashTypes(value string) []string {
+	var hashTypes []string
+	for _, hashType := range strings.Split(value, ",") {
+		if hashType = strings.TrimSpace(hashType); hashType != "" {
+			hashTypes = append(hashTypes, hashType)
 		}
 	}
-	return output, errs
+	return hashTypes
 }
 
-// writeResultsToFile saves the collected hash results to a specified file.
-// It cleans the filename to mitigate directory traversal risks.
-func writeResultsToFile(filename string, results map[string]string) (err error) {
-	// Clean and localize the filename to mitigate G304.
-	// We use filepath.Clean to resolve any directory traversal elements.
-	filename = filepath.Clean(filename)
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
+// runStats counts the outcome of the processed files and the bytes hashed. Failed counts the
+// files that could not be hashed or renamed, leaving out the errors of the whole run such as
+// an unreadable root, and Unreadable the directories whose files were skipped because they
+// could not be read, and Changed the files modified while hashed, as detected by --restat.
+// Reused files and hard links whose digests were reused are completed without being read, so
+// their bytes are not counted.
+// Done lists the paths of the completed files when there is an output file, for the sidecar
+// files written if the run is interrupted.
+type runStats struct {
+	Completed  int
+	Skipped    int
+	Reused     int
+	Failed     int
+	Unreadable int
+	Changed    int
+	Bytes      int64
+	Done       []string
+}
+
+// processResults iterates over the results channel and handles renaming or display.
+// Results are written to stream as they arrive when it is not nil. They are only collected
+// in the returned map for the json format, which is sorted, and for the aggregate reports.
+// Files aborted by a cancellation are counted as skipped rather than reported as errors.
+// Directories that could not be read are reported as errors, or only as warnings with --skip-errors.
+// Results are inserted into db and posted by hook when they are not nil, before any rename.
+// Files are renamed by ren when it is not nil, using the digest of the first requested hash type.
+// Files modified while hashed are reported as warnings, and neither cached nor renamed.
+// With --hash-empty-as, the digests of empty files are replaced by the marker in the output,
+// while the cache and the renames keep the actual digests.
+// Each file result, successful or not, is counted by prog when it is not nil.
+// With --fail-fast, the first error calls cancel to stop the remaining work.
+// The errors are logged and returned once all results are processed, sorted by path, so that
+// repeated runs list them identically whatever the order the workers complete the files in;
+// the ndjson records and the webhook batches still report them as they arrive.
+func processResults(results <-chan pipeline.Result, cfg *Config, stream *resultStream, db *sqliteStore, hook *webhookSender, ren *renamer, prog *progress, cancel context.CancelFunc) (map[string]pipeline.Result, []error, runStats) {
+	output := make(map[string]pipeline.Result)
+	var errs []error
+	var stats runStats
+	fail := func(err error) {
+		errs = append(errs, err)
+		if stream != nil {
+			stream.writeError(err)
+		}
+		if hook != nil {
+			hook.addError(err)
+		}
+		if cfg.FailFast {
+			cancel()
+		}
 	}
-	defer func() {
-		closeErr := file.Close()
-		if err == nil {
-			err = closeErr
+
+	for result := range results {
+		if errors.Is(result.Error, context.Canceled) {
+			stats.Skipped++
+			logger.Debug("skipped file in progress", "path", result.FilePath)
+			continue
+		}
+		var walkErr *pipeline.WalkError
+		if errors.As(result.Error, &walkErr) {
+			stats.Unreadable++
+			if cfg.SkipErrors {
+				logError(slog.LevelWarn, &fileError{Op: "processing", Path: result.FilePath, Err: result.Error})
+			} else {
+				fail(&fileError{Op: "processing", Path: result.FilePath, Err: result.Error})
+			}
+			continue
+		}
+		if prog != nil && result.FilePath != "" {
+			prog.fileDone()
+		}
+		if result.Error != nil {
+			if result.FilePath != "" {
+				stats.Failed++
+			}
+			fail(&fileError{Op: "processing", Path: result.FilePath, Err: result.Error})
+			continue
 		}
-	}()
 
-	for filePath, hash := range results {
-		if _, err = fmt.Fprintf(file, "%s: %s\n", filePath, hash); err != nil {
-			return err
+		if result.Changed {
+			stats.Changed++
+			logger.Warn("file modified while hashed", "path", result.FilePath)
+		}
+		if cfg.cache != nil && !result.Changed {
+			cfg.cache.add(result)
+		}
+		digest := result.Hashes[cfg.HashTypes[0]]
+		if cfg.EmptyAs != "" && result.Size == 0 && result.Link == "" {
+			result.Hashes = markEmpty(result.Hashes, cfg.EmptyAs)
+		}
+		if stream != nil {
+			stream.writeResult(result)
+		}
+		if db != nil {
+			db.add(result)
+		}
+		if hook != nil {
+			hook.add(result)
+		}
+		if cfg.Format == formatJSON || cfg.aggregate() {
+			output[result.FilePath] = result
+		}
+		stats.Completed++
+		if cfg.OutFile != "" {
+			stats.Done = append(stats.Done, result.FilePath)
+		}
+		if result.Reused {
+			stats.Reused++
+		} else if result.Alias == "" {
+			stats.Bytes += result.Size
+		}
+		logTiming(result)
+
+		if ren != nil && !isURL(result.FilePath) && !result.Changed {
+			if err := ren.rename(result.FilePath, digest); err != nil {
+				stats.Failed++
+				fail(&fileError{Op: "renaming", Path: result.FilePath, Err: err})
+			}
 		}
 	}
-	return nil
+	sortErrors(errs)
+	for _, err := range errs {
+		logError(slog.LevelError, err)
+	}
+	return output, errs, stats
+}
+
+// sortErrors sorts errors by the path of their file, keeping the order of the errors of the
+// same file. The errors of the whole run, without a path, come first.
+func sortErrors(errs []error) {
+	slices.SortStableFunc(errs, func(a, b error) int {
+		return strings.Compare(errorPath(a), errorPath(b))
+	})
+}
+
+// cacheRoot returns the directory under which the --cache entries of the files that no longer
+// exist can be dropped: that of --path when the run walked its whole tree, and an empty string
+// when the run hashed a list of files, was stopped, possibly by --max-files, or could not open
+// the root.
+func (cfg *Config) cacheRoot(ctx context.Context, errs []error) string {
+	if cfg.FilesFrom != "" || cfg.MaxFiles > 0 || cfg.remote || ctx.Err() != nil || runFailed(errs) || pipeline.RootDir(cfg.Path) != cfg.Path {
+		return ""
+	}
+	return cfg.Path
+}
+
+// runFailed reports whether errs hold an error of the whole run rather than of a file, such
+// as the root that could not be opened, which means that no file was hashed.
+func runFailed(errs []error) bool {
+	return slices.ContainsFunc(errs, func(err error) bool { return errorPath(err) == "" })
+}
+
+// errorPath returns the path of the file an error is tied to, or an empty string.
+func errorPath(err error) string {
+	var fe *fileError
+	if errors.As(err, &fe) {
+		return fe.Path
+	}
+	return ""
 }
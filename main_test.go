@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"criticalsys.net/hashcalcmt/hasher"
+)
+
+// runMainEnv makes the test binary run main instead of the tests, so that the tests can run
+// the command as a separate process with its own flags and exit status.
+const runMainEnv = "HASHCALCMT_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runCommand runs the command with args and returns its standard output.
+func runCommand(t *testing.T, args ...string) string {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...) // #nosec G204 -- the test binary runs itself
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return string(out)
+}
+
+// exitStatus runs the command with args and returns its exit status.
+func exitStatus(t *testing.T, args ...string) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...) // #nosec G204 -- the test binary runs itself
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return 0
+}
+
+// TestSingleFilePath checks that a file given as --path is hashed and printed under its name,
+// even when --file-pattern does not match it.
+func TestSingleFilePath(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(file, []byte("abc"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	const want = "data.bin: ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad\n"
+	for _, pattern := range []string{"*", "*.txt"} {
+		got := runCommand(t, "--path", file, "--hash", "SHA256", "--file-pattern", pattern, "--log-level", "error")
+		if got != want {
+			t.Errorf("--file-pattern %s: got %q, want %q", pattern, got, want)
+		}
+	}
+}
+
+// TestMissingPathStatus checks that a --path that cannot be opened fails the whole run with
+// the fatal exit status, rather than the status of files that could not be hashed.
+func TestMissingPathStatus(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing")
+	if got := exitStatus(t, "--path", path, "--quiet", "--log-level", "error"); got != exitFatal {
+		t.Errorf("exit status %d, want %d", got, exitFatal)
+	}
+}
+
+// TestCacheKeepsUnvisitedEntries checks that a run that does not hash every file keeps the
+// cache entries of the others, and that a full run drops those of the deleted files.
+func TestCacheKeepsUnvisitedEntries(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.log"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache := filepath.Join(t.TempDir(), "hashes.cache")
+	entries := func() int {
+		t.Helper()
+		data, err := os.ReadFile(cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(data), "\n")
+	}
+	run := func(wantStatus int, args ...string) {
+		t.Helper()
+		args = append([]string{"--cache", cache, "--quiet", "--log-level", "error"}, args...)
+		if got := exitStatus(t, args...); got != wantStatus {
+			t.Fatalf("%v: exit status %d, want %d", args, got, wantStatus)
+		}
+	}
+
+	run(0, "--path", dir)
+	if got := entries(); got != 3 {
+		t.Fatalf("full run cached %d entries, want 3", got)
+	}
+	for _, tt := range []struct {
+		status int
+		args   []string
+	}{
+		{0, []string{"--path", dir, "--file-pattern", "*.log"}},
+		{0, []string{"--path", dir, "--exclude", "a.txt"}},
+		{0, []string{"--path", filepath.Join(dir, "a.txt")}},
+		{exitFatal, []string{"--path", filepath.Join(dir, "missing")}},
+	} {
+		run(tt.status, tt.args...)
+		if got := entries(); got != 3 {
+			t.Errorf("%v: %d cache entries left, want 3", tt.args, got)
+		}
+	}
+	if err := os.Remove(filepath.Join(dir, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	run(0, "--path", dir, "--file-pattern", "*.log")
+	if got := entries(); got != 2 {
+		t.Errorf("filtered run after a deletion: %d cache entries, want 2", got)
+	}
+}
+
+// TestCheckIgnoresMaxFiles checks that --check verifies every entry of a manifest, whatever
+// --max-files, which only limits the files hashed to write a manifest.
+func TestCheckIgnoresMaxFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"f1", "f2", "f3", "f4"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := filepath.Join(t.TempDir(), "manifest.txt")
+	runCommand(t, "--path", dir, "--hash", "SHA256", "--out-file", manifest, "--quiet", "--log-level", "error")
+	if got := exitStatus(t, "--path", dir, "--hash", "SHA256", "--check", manifest, "--max-files", "2", "--quiet", "--log-level", "error"); got != 0 {
+		t.Errorf("exit status %d, want 0", got)
+	}
+}
+
+// TestSymlinkMarker checks that the line formats mark the symbolic links hashed by their target
+// path with a comment line, and that --check skips it to verify the link.
+func TestSymlinkMarker(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a"), []byte("abc"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a", filepath.Join(dir, "l")); err != nil {
+		t.Skip("symbolic links not supported:", err)
+	}
+	for _, format := range []string{"text", "coreutils"} {
+		manifest := filepath.Join(t.TempDir(), "manifest.txt")
+		args := []string{"--path", dir, "--hash", "SHA256", "--hash-symlink-target=false", "--format", format, "--log-level", "error"}
+		runCommand(t, append(args, "--out-file", manifest)...)
+		data, err := os.ReadFile(manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "# symlink: l -> a\n") {
+			t.Errorf("%s: no symlink marker in %q", format, data)
+		}
+		if got := exitStatus(t, append(args, "--check", manifest, "--quiet")...); got != 0 {
+			t.Errorf("%s: --check exit status %d, want 0", format, got)
+		}
+	}
+}
+
+// TestHashTypesMatchHasher checks that the command supports the same hash types as the hasher
+// package: --list-hashes and the --hash help list them all, and --hash hashes each of them
+// to the digest of the package.
+func TestHashTypesMatchHasher(t *testing.T) {
+	want := hasher.SupportedHashes()
+	if got := strings.Fields(runCommand(t, "--list-hashes")); !slices.Equal(got, want) {
+		t.Errorf("--list-hashes: got %v, want %v", got, want)
+	}
+
+	cmd := exec.Command(os.Args[0], "-h") // #nosec G204 -- the test binary runs itself
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	var usage bytes.Buffer
+	cmd.Stderr = &usage
+	_ = cmd.Run() // #nosec G104 -- the help is checked instead of the exit status
+	_, help, _ := strings.Cut(usage.String(), "computed in a single pass: ")
+	help, _, _ = strings.Cut(help, " (default")
+	if got := strings.Split(help, ", "); !slices.Equal(got, want) {
+		t.Errorf("--hash help: got %v, want %v", got, want)
+	}
+
+	data := []byte("hashcalcmt")
+	file := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, hashType := range want {
+		hf, err := hasher.GetHasher(hashType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, err := hf(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := runCommand(t, "--path", file, "--hash", hashType, "--log-level", "error"); got != "data.bin: "+digest+"\n" {
+			t.Errorf("--hash %s: got %q, want digest %s", hashType, got, digest)
+		}
+	}
+	if got := exitStatus(t, "--path", file, "--hash", "NOPE", "--log-level", "error"); got != exitFatal {
+		t.Errorf("--hash NOPE: exit status %d, want %d", got, exitFatal)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"criticalsys.net/hashcalcmt/hasher"
+	"criticalsys.net/hashcalcmt/pipeline"
+)
+
+// Path styles supported by the --path-style flag.
+const (
+	pathStyleRelative = "relative"
+	pathStyleAbsolute = "absolute"
+)
+
+// Output formats supported by the --format flag.
+const (
+	formatText = "text"
+	formatJSON = "json"
+	// formatNDJSON writes one JSON object per line as the results arrive, without buffering them.
+	formatNDJSON = "ndjson"
+	// formatCoreutils writes "<hash>  <path>" lines understood by md5sum/sha256sum -c.
+	formatCoreutils = "coreutils"
+)
+
+// Layouts of the coreutils format selected by --checksum-style.
+const (
+	// checksumStyleGNU writes "<hash>  <path>" lines, as md5sum and sha256sum do by default.
+	checksumStyleGNU = "gnu"
+	// checksumStyleBSD writes "TYPE (path) = hash" lines, as the BSD and macOS md5 and shasum
+	// tools do, and coreutils with --tag.
+	checksumStyleBSD = "bsd"
+)
+
+// fileError is an error tied to a specific file.
+// It keeps the path separate so machine-readable formats can report it.
+type fileError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+// Error formats the error as "error <op> file <path>: <cause>".
+func (e *fileError) Error() string {
+	return fmt.Sprintf("error %s file %s: %v", e.Op, e.Path, e.Err)
+}
+
+// Unwrap returns the underlying cause.
+func (e *fileError) Unwrap() error {
+	return e.Err
+}
+
+// jsonRecord is a single entry of the JSON output.
+// Successful entries carry a hash, an algorithm and the size in bytes, failed entries carry an error.
+// Symbolic links hashed by their target path carry that target, and the hard links whose
+// digests were reused carry the path they were reused from. With --with-metadata, records
+// carry the octal mode, the owner IDs, unless unknown, and the modification time of the file.
+// Files modified while hashed, as detected by --restat, are marked as changed.
+type jsonRecord struct {
+	Path      string `json:"path"`
+	Hash      string `json:"hash,omitempty"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Size      *int64 `json:"size,omitempty"`
+	Link      string `json:"link,omitempty"`
+	Alias     string `json:"alias,omitempty"`
+	Mode      string `json:"mode,omitempty"`
+	UID       *int   `json:"uid,omitempty"`
+	GID       *int   `json:"gid,omitempty"`
+	ModTime   string `json:"mtime,omitempty"`
+	Changed   bool   `json:"changed,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// validateFormat checks that the requested output format and checksum style are supported
+// and compatible with the requested hash types and digest encoding. The bsd style names the
+// hash type on every line, so that it supports several of them.
+func validateFormat(format, style string, hashTypes []string, encoding string) error {
+	switch style {
+	case checksumStyleGNU:
+	case checksumStyleBSD:
+		if format != formatCoreutils {
+			return fmt.Errorf("checksum style %s requires the %s format", style, formatCoreutils)
+		}
+	default:
+		return fmt.Errorf("unsupported checksum style: %s", style)
+	}
+	switch format {
+	case formatText, formatJSON, formatNDJSON:
+		return nil
+	case formatCoreutils:
+		if len(hashTypes) > 1 && style != checksumStyleBSD {
+			return fmt.Errorf("output format %s supports a single hash type", format)
+		}
+		if encoding != hasher.EncodingHex {
+			return fmt.Errorf("output format %s requires the %s encoding", format, hasher.EncodingHex)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported output format: %s", format)
+	}
+}
+
+// validateLineTemplate checks that an output template only uses the supported placeholders:
+// {path}, {hash}, {algo} and {size}. The digest must be part of the line.
+func validateLineTemplate(template string) error {
+	for _, m := range templatePlaceholder.FindAllStringSubmatch(template, -1) {
+		switch {
+		case m[2] != "":
+			return fmt.Errorf("invalid output template placeholder %s: placeholders do not accept a length", m[0])
+		case m[1] == "path" || m[1] == "hash" || m[1] == "algo" || m[1] == "size":
+		default:
+			return fmt.Errorf("unknown output template placeholder %s", m[0])
+		}
+	}
+	if !strings.Contains(template, "{hash}") {
+		return errors.New("the output template must include {hash}")
+	}
+	return nil
+}
+
+// renderLine returns a result line from the output template. {path} is the path as written by
+// the text format, {hash} the digest, {algo} the hash type and {size} the size in bytes.
+func renderLine(template, filePath, algorithm, hash string, size int64) string {
+	return templatePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		switch placeholder {
+		case "{path}":
+			return filePath
+		case "{hash}":
+			return hash
+		case "{algo}":
+			return algorithm
+		default:
+			return strconv.FormatInt(size, 10)
+		}
+	})
+}
+
+// formatLine renders a single result line in the configured line-based format.
+// The text format is "path: hash", with the type added as "path (TYPE): hash"
+// when several hash types are computed. A single hash of standard input is
+// rendered alone so it composes in shell pipelines. An --output-template replaces
+// the text format entirely, standard input included.
+func formatLine(filePath, hashType, hash string, size int64, cfg *Config) string {
+	if cfg.Format == formatCoreutils && cfg.SumStyle == checksumStyleBSD {
+		return formatBSDLine(filePath, cfg.algorithm(hashType), hash)
+	}
+	if cfg.Format == formatCoreutils {
+		return formatCoreutilsLine(filePath, hash)
+	}
+	if cfg.LineTmpl != "" {
+		return renderLine(cfg.LineTmpl, filePath, cfg.algorithm(hashType), hash, size)
+	}
+	if len(cfg.HashTypes) > 1 {
+		return fmt.Sprintf("%s (%s): %s", filePath, cfg.algorithm(hashType), hash)
+	}
+	if filePath == stdinPath {
+		return hash
+	}
+	return fmt.Sprintf("%s: %s", filePath, hash)
+}
+
+// coreutilsEscaper escapes the characters GNU coreutils escapes in checksum file names.
+var coreutilsEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`)
+
+// formatCoreutilsLine renders a line as "<hash>  <path>", the layout expected by sha256sum -c.
+// Paths are written with forward slashes and relative to --path, so the manifest must be
+// verified from that directory. Windows builds use the "*" binary marker, matching the
+// default mode of coreutils on that platform. Names containing a backslash or a newline
+// are escaped and the line is prefixed with a backslash, as coreutils does.
+func formatCoreutilsLine(filePath, hash string) string {
+	name, prefix := coreutilsName(filePath)
+	marker := " "
+	if runtime.GOOS == "windows" {
+		marker = "*"
+	}
+	return fmt.Sprintf("%s%s %s%s", prefix, hash, marker, name)
+}
+
+// formatBSDLine renders a line as "TYPE (path) = hash", the layout of the BSD checksum tools
+// and of coreutils with --tag. Paths are written and escaped as by formatCoreutilsLine.
+func formatBSDLine(filePath, algorithm, hash string) string {
+	name, prefix := coreutilsName(filePath)
+	return fmt.Sprintf("%s%s (%s) = %s", prefix, algorithm, name, hash)
+}
+
+// coreutilsName returns a path with forward slashes as written in a checksum line, escaped
+// when it contains a backslash or a newline along with the backslash prefixing the line.
+func coreutilsName(filePath string) (name, prefix string) {
+	name = filepath.ToSlash(filePath)
+	if strings.ContainsAny(name, "\\\n\r") {
+		return coreutilsEscaper.Replace(name), `\`
+	}
+	return name, ""
+}
+
+// writeResultsToFile saves the collected hash results to the output file, to the --s3 object
+// or to the --shard-output shards, in the json format, the only format that is not streamed
+// because its records are sorted. The file is replaced atomically, as opened by openOutFile.
+func writeResultsToFile(results map[string]pipeline.Result, errs []error, cfg *Config) error {
+	if cfg.ShardDir != "" {
+		return writeJSONShards(results, cfg)
+	}
+	w, finish, err := openOutFile(cfg)
+	if err != nil {
+		return err
+	}
+	return finish(writeJSON(w, results, errs, cfg))
+}
+
+// atomicFile is written under a temporary name in the directory of its destination, and
+// renamed over it once complete, so that a crash or a failed write never leaves a partial
+// file in place of the previous one.
+type atomicFile struct {
+	*os.File
+	name string
+}
+
+// createAtomic creates the temporary file of an atomic write to name. It keeps the permissions
+// of the file it replaces, so that a manifest shared with other users stays readable by them.
+func createAtomic(name string) (*atomicFile, error) {
+	var perm os.FileMode = 0o644
+	if info, err := os.Stat(name); err == nil {
+		perm = info.Mode().Perm()
+	}
+	file, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	// CreateTemp restricts the file to its owner, unlike os.Create.
+	if err := file.Chmod(perm); err != nil {
+		_ = file.Close()           // #nosec G104 -- the chmod error is reported instead
+		_ = os.Remove(file.Name()) // #nosec G104 -- the chmod error is reported instead
+		return nil, err
+	}
+	return &atomicFile{File: file, name: name}, nil
+}
+
+// Commit syncs the file to disk, so that it survives a power loss, and renames it over its
+// destination. The temporary file is removed if any step fails.
+func (f *atomicFile) Commit() error {
+	err := f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), f.name)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name()) // #nosec G104 -- the write error is reported instead
+	}
+	return err
+}
+
+// Abort closes and removes the temporary file, leaving the destination untouched.
+func (f *atomicFile) Abort() {
+	_ = f.Close()           // #nosec G104 -- the file is discarded
+	_ = os.Remove(f.Name()) // #nosec G104 -- the file is discarded
+}
+
+// writeJSON renders the results as a JSON array sorted by path, one object per file and algorithm.
+// Errors are appended as objects with an "error" field when --json-errors is set. With --header,
+// the array is the "results" field of an object whose "header" field holds the manifest header.
+func writeJSON(w io.Writer, results map[string]pipeline.Result, errs []error, cfg *Config) error {
+	paths := make([]string, 0, len(results))
+	for filePath := range results {
+		paths = append(paths, filePath)
+	}
+	sort.Strings(paths)
+
+	records := make([]jsonRecord, 0, len(results)*len(cfg.HashTypes))
+	for _, filePath := range paths {
+		for _, hashType := range cfg.HashTypes {
+			result := results[filePath]
+			records = append(records, cfg.record(result, hashType))
+		}
+	}
+	if cfg.JSONErrors {
+		for _, err := range errs {
+			records = append(records, errorRecord(err))
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if cfg.header != nil {
+		return enc.Encode(struct {
+			Header  *manifestHeader `json:"header"`
+			Results []jsonRecord    `json:"results"`
+		}{cfg.header, records})
+	}
+	return enc.Encode(records)
+}
+
+// record returns the JSON record of the digest of a result for one hash type.
+func (cfg *Config) record(result pipeline.Result, hashType string) jsonRecord {
+	record := jsonRecord{Path: cfg.outputPath(result.FilePath), Hash: result.Hashes[hashType], Algorithm: cfg.algorithm(hashType), Size: &result.Size, Link: result.Link}
+	if result.Alias != "" {
+		record.Alias = cfg.outputPath(result.Alias)
+	}
+	record.Changed = result.Changed
+	if meta := result.Meta; meta != nil {
+		record.Mode = fmt.Sprintf("%04o", meta.UnixMode())
+		if meta.UID >= 0 {
+			record.UID, record.GID = &meta.UID, &meta.GID
+		}
+		record.ModTime = result.ModTime.UTC().Format(time.RFC3339Nano)
+	}
+	return record
+}
+
+// errorRecord converts an error to a JSON record, with the path of the file when known.
+func errorRecord(err error) jsonRecord {
+	record := jsonRecord{Error: err.Error()}
+	var fe *fileError
+	if errors.As(err, &fe) {
+		record.Path = fe.Path
+	}
+	return record
+}
+
+// resultStream writes the results as they arrive, in the ndjson format or a line format,
+// so that they do not need to be held in memory, to w or else to the shards of their digests.
+// The first write error is kept and stops further writes.
+type resultStream struct {
+	w      io.Writer
+	shards *shardSet
+	cfg    *Config
+	err    error
+}
+
+// writeResult writes one record or line per requested hash type of a file. The size is only
+// written by the ndjson format: the line formats stay compatible with the hash-only tools.
+// Symbolic links hashed by their target path are marked by a "link" field with the ndjson
+// format, and preceded by a "# symlink: path -> target" comment line with the line formats,
+// which --check and the coreutils tools skip. An --output-template line has no marker.
+func (s *resultStream) writeResult(result pipeline.Result) {
+	if s.shards != nil {
+		s.shards.writeResult(result)
+		return
+	}
+	if result.Link != "" && s.cfg.Format != formatNDJSON && s.cfg.LineTmpl == "" {
+		s.writeLine(symlinkComment(s.cfg.outputPath(result.FilePath), result.Link))
+	}
+	for _, hashType := range s.cfg.HashTypes {
+		if s.cfg.Format == formatNDJSON {
+			s.writeRecord(s.cfg.record(result, hashType))
+		} else {
+			s.writeLine(formatLine(s.cfg.outputPath(result.FilePath), hashType, result.Hashes[hashType], result.Size, s.cfg))
+		}
+	}
+}
+
+// symlinkComment returns the comment line marking a symbolic link in the line formats, its
+// path and target escaped as by coreutilsName so that the comment holds on one line.
+func symlinkComment(filePath, target string) string {
+	return "# symlink: " + coreutilsEscaper.Replace(filepath.ToSlash(filePath)) + " -> " + coreutilsEscaper.Replace(target)
+}
+
+// writeError writes an error record with the ndjson format when --json-errors is set.
+// The line formats have no representation for errors, which are only reported on stderr.
+func (s *resultStream) writeError(err error) {
+	if s.cfg.Format == formatNDJSON && s.cfg.JSONErrors {
+		s.writeRecord(errorRecord(err))
+	}
+}
+
+// writeHeader writes the manifest header, as a {"header": ...} record with the ndjson format,
+// or otherwise as comment lines.
+func (s *resultStream) writeHeader(header *manifestHeader) {
+	if s.cfg.Format == formatNDJSON {
+		if s.err != nil {
+			return
+		}
+		line, err := json.Marshal(struct {
+			Header *manifestHeader `json:"header"`
+		}{header})
+		if err == nil {
+			_, err = fmt.Fprintf(s.w, "%s\n", line)
+		}
+		s.err = err
+		return
+	}
+	for _, line := range header.lines() {
+		s.writeLine(line)
+	}
+}
+
+// writeLine writes a single line.
+func (s *resultStream) writeLine(line string) {
+	if s.err == nil {
+		_, s.err = fmt.Fprintln(s.w, line)
+	}
+}
+
+// writeRecord writes a single record as a line of compact JSON.
+func (s *resultStream) writeRecord(record jsonRecord) {
+	if s.err != nil {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err == nil {
+		_, err = fmt.Fprintf(s.w, "%s\n", line)
+	}
+	s.err = err
+}
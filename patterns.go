@@ -0,0 +1,83 @@
+package main
+
+import "strings"
+
+// splitList splits a comma-separated list, ignoring the commas within braces so that brace
+// expressions such as "*.{jpg,png}" are kept whole. Surrounding whitespace and empty entries are ignored.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range splitTopLevel(value) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// splitTopLevel splits value on the commas that are neither within braces nor escaped with a backslash.
+func splitTopLevel(value string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++ // Skip the escaped character.
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				parts = append(parts, value[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, value[start:])
+}
+
+// expandBraces expands the brace expressions of a glob pattern, so that "*.{jpg,png}"
+// yields "*.jpg" and "*.png". Nested braces are expanded recursively, empty alternatives
+// are kept so that "file{,.bak}" yields "file" and "file.bak", and a pattern with
+// unbalanced braces is returned unchanged.
+func expandBraces(pattern string) []string {
+	open, depth := -1, 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '{':
+			if depth == 0 {
+				open = i
+			}
+			depth++
+		case '}':
+			if depth == 0 {
+				continue
+			}
+			if depth--; depth > 0 {
+				continue
+			}
+			prefix, suffix := pattern[:open], pattern[i+1:]
+			var expanded []string
+			for _, alternative := range splitTopLevel(pattern[open+1 : i]) {
+				expanded = append(expanded, expandBraces(prefix+alternative+suffix)...)
+			}
+			return expanded
+		}
+	}
+	return []string{pattern}
+}
+
+// parsePatterns splits comma-separated lists of glob patterns and expands their brace expressions.
+func parsePatterns(values ...string) []string {
+	var patterns []string
+	for _, value := range values {
+		for _, item := range splitList(value) {
+			patterns = append(patterns, expandBraces(item)...)
+		}
+	}
+	return patterns
+}
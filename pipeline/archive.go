@@ -0,0 +1,152 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"criticalsys.net/hashcalcmt/hasher"
+	"golang.org/x/time/rate"
+)
+
+// ArchiveSeparator separates the path of an archive from the name of an entry within it,
+// as in "bundle.zip!/inner/file.txt".
+const ArchiveSeparator = "!/"
+
+// isArchive reports whether the file name has the extension of a supported archive:
+// .zip, .tar, .tar.gz or .tgz.
+func isArchive(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// entryPath names an archive entry after the archive. The entry name is cleaned, so that
+// "./dir/file" stored by tar and "dir/file" stored by zip are reported identically.
+func entryPath(filePath, name string) string {
+	return filePath + ArchiveSeparator + path.Clean(name)
+}
+
+// hashArchive hashes every regular file stored in the archive at filePath and passes
+// a Result per entry to emit, named after the archive and the entry. An archive that
+// cannot be read is reported as a single Result for the archive itself; entries
+// emitted before a read error are kept.
+func hashArchive(ctx context.Context, root *os.Root, filePath string, hf hasher.MultiFunc, limiter *rate.Limiter, emit func(Result)) {
+	if err := readArchive(ctx, root, filePath, hf, limiter, emit); err != nil {
+		emit(Result{FilePath: filePath, Error: err})
+	}
+}
+
+// readArchive opens the archive through the root and dispatches on its format.
+func readArchive(ctx context.Context, root *os.Root, filePath string, hf hasher.MultiFunc, limiter *rate.Limiter, emit func(Result)) (err error) {
+	file, err := root.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("could not open file: %w", err)
+	}
+	defer func() {
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	name := strings.ToLower(filePath)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		return hashZip(ctx, file, info.Size(), filePath, hf, limiter, emit)
+	case strings.HasSuffix(name, ".tar"):
+		return hashTar(ctx, file, filePath, hf, limiter, emit)
+	default:
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			closeErr := gz.Close()
+			if err == nil {
+				err = closeErr
+			}
+		}()
+		return hashTar(ctx, gz, filePath, hf, limiter, emit)
+	}
+}
+
+// hashZip hashes the regular files of a zip archive in the order of its central directory.
+// The rate limiter, when not nil, throttles the decompressed bytes read.
+func hashZip(ctx context.Context, r io.ReaderAt, size int64, filePath string, hf hasher.MultiFunc, limiter *rate.Limiter, emit func(Result)) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		begin := time.Now()
+		hashes, n, err := hashZipEntry(ctx, f, hf, limiter)
+		emit(Result{FilePath: entryPath(filePath, f.Name), Hashes: hashes, Size: n, ModTime: f.Modified, Duration: time.Since(begin), Error: err})
+	}
+	return nil
+}
+
+// hashZipEntry decompresses and hashes a single zip entry.
+// A checksum mismatch of a corrupt entry is reported as an error of the entry.
+func hashZipEntry(ctx context.Context, f *zip.File, hf hasher.MultiFunc, limiter *rate.Limiter) (hashes map[string]string, size int64, err error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		closeErr := rc.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	cr := &contextReader{ctx: ctx, r: rc, limiter: limiter}
+	hashes, err = hf(cr)
+	return hashes, cr.n, err
+}
+
+// hashTar hashes the regular files of a tar stream in the order they are stored.
+func hashTar(ctx context.Context, r io.Reader, filePath string, hf hasher.MultiFunc, limiter *rate.Limiter, emit func(Result)) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		begin := time.Now()
+		cr := &contextReader{ctx: ctx, r: tr, limiter: limiter}
+		hashes, err := hf(cr)
+		if err != nil {
+			// A failed read leaves the stream at an unknown position, so the archive cannot be read further.
+			return fmt.Errorf("%s: %w", header.Name, err)
+		}
+		emit(Result{FilePath: entryPath(filePath, header.Name), Hashes: hashes, Size: cr.n, ModTime: header.ModTime, Duration: time.Since(begin)})
+	}
+}
@@ -0,0 +1,71 @@
+package pipeline
+
+import (
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// openCopyRoot creates the Options.CopyTo directory if needed and opens it as an os.Root,
+// so that the copies cannot be written outside of it.
+func openCopyRoot(dir string) (*os.Root, error) {
+	if err := os.MkdirAll(longPath(dir), 0o750); err != nil {
+		return nil, err
+	}
+	return os.OpenRoot(longPath(dir))
+}
+
+// fileCopy is the copy of a file written while it is hashed, under a temporary name in the
+// directory of its destination, and renamed into place once complete so that an aborted copy
+// never leaves a partial file behind.
+type fileCopy struct {
+	root *os.Root
+	file *os.File
+	temp string
+	name string
+}
+
+// createCopy creates the temporary file of the copy of a file to name, relative to root,
+// with the directories leading to it and the permissions perm.
+func createCopy(root *os.Root, name string, perm os.FileMode) (*fileCopy, error) {
+	dir := filepath.Dir(name)
+	if err := root.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	temp := filepath.Join(dir, "."+filepath.Base(name)+"."+strconv.FormatUint(rand.Uint64(), 36)+".tmp") // #nosec G404 -- the suffix only avoids name clashes
+	file, err := root.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &fileCopy{root: root, file: file, temp: temp, name: name}, nil
+}
+
+// Write writes to the copy.
+func (c *fileCopy) Write(p []byte) (int, error) {
+	return c.file.Write(p)
+}
+
+// finish syncs the copy to disk, sets its modification time and renames it over its
+// destination, unless err is not nil, in which case the copy is removed. It returns the
+// first error of these steps, not err.
+func (c *fileCopy) finish(err error, modTime time.Time) error {
+	var copyErr error
+	if err == nil {
+		copyErr = c.file.Sync()
+	}
+	if closeErr := c.file.Close(); copyErr == nil {
+		copyErr = closeErr
+	}
+	if err == nil && copyErr == nil {
+		copyErr = c.root.Chtimes(c.temp, time.Time{}, modTime)
+	}
+	if err == nil && copyErr == nil {
+		copyErr = c.root.Rename(c.temp, c.name)
+	}
+	if err != nil || copyErr != nil {
+		_ = c.root.Remove(c.temp) // #nosec G104 -- the copy is discarded
+	}
+	return copyErr
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package pipeline
+
+import "os"
+
+// fileID is not supported on this platform: os.FileInfo does not carry the file index.
+func fileID(os.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
+
+// linkCount is not supported on this platform, so that every file is hashed on its own.
+func linkCount(os.FileInfo) uint64 {
+	return 1
+}
+
+// fileOwner is not supported on this platform, whose files are not owned by numeric IDs.
+func fileOwner(os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,35 @@
+//go:build unix
+
+package pipeline
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns the device and inode numbers identifying a file on this system,
+// and false when they are not available.
+func fileID(info os.FileInfo) (dev, ino uint64, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(st.Dev), uint64(st.Ino), true // #nosec G115 -- device numbers are never negative
+}
+
+// linkCount returns the number of hard links to a file, or 1 when it is not available.
+func linkCount(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink) // #nosec G115 -- link counts are never negative
+	}
+	return 1
+}
+
+// fileOwner returns the user and group IDs owning a file, and false when they are not available.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
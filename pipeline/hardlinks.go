@@ -0,0 +1,59 @@
+package pipeline
+
+import (
+	"os"
+	"sync"
+)
+
+// linkKey identifies a file by its device and inode numbers.
+type linkKey struct {
+	dev, ino uint64
+}
+
+// linkEntry is the outcome of hashing the first path of a file with several hard links,
+// set before done is closed. ok is false when hashing it failed.
+type linkEntry struct {
+	path   string
+	done   chan struct{}
+	hashes map[string]string
+	size   int64
+	ok     bool
+}
+
+// linkTable tracks the files with several hard links hashed during a run, as selected by
+// Options.Hardlinks, so that each is read once whatever the number of its paths.
+type linkTable struct {
+	mu      sync.Mutex
+	entries map[linkKey]*linkEntry
+}
+
+// newLinkTable returns an empty table.
+func newLinkTable() *linkTable {
+	return &linkTable{entries: make(map[linkKey]*linkEntry)}
+}
+
+// claim returns the entry of the file described by info, and whether the caller is the
+// first to claim it, in which case it must hash the file and call finish. It returns nil
+// for the files with a single link, or when the platform does not identify files.
+func (t *linkTable) claim(info os.FileInfo, path string) (entry *linkEntry, first bool) {
+	dev, ino, ok := fileID(info)
+	if !ok || linkCount(info) < 2 {
+		return nil, false
+	}
+	key := linkKey{dev, ino}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if entry, ok := t.entries[key]; ok {
+		return entry, false
+	}
+	entry = &linkEntry{path: path, done: make(chan struct{})}
+	t.entries[key] = entry
+	return entry, true
+}
+
+// finish records the outcome of hashing the first path of a file and releases the workers
+// waiting for it.
+func (e *linkEntry) finish(hashes map[string]string, size int64, ok bool) {
+	e.hashes, e.size, e.ok = hashes, size, ok
+	close(e.done)
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package pipeline
+
+// longPath returns path as is: only Windows limits the length of paths below the limits
+// of the file system.
+func longPath(path string) string {
+	return path
+}
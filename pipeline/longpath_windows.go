@@ -0,0 +1,30 @@
+//go:build windows
+
+package pipeline
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// extendedPrefix disables the MAX_PATH limit of 260 characters of the Windows file APIs,
+// along with the normalization of the path, which must therefore be absolute and clean.
+const extendedPrefix = `\\?\`
+
+// longPath returns the extended-length form of a path, so that the files of deep trees can be
+// opened: `\\?\C:\dir` for a drive path, or `\\?\UNC\server\share\dir` for a UNC share.
+// Relative paths are made absolute first. Paths already in that form, such as `\\?\` or
+// `\\.\` device paths, are returned as is, as is a path that cannot be made absolute.
+func longPath(path string) string {
+	if strings.HasPrefix(path, extendedPrefix) || strings.HasPrefix(path, `\\.\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if unc, ok := strings.CutPrefix(abs, `\\`); ok {
+		return extendedPrefix + `UNC\` + unc
+	}
+	return extendedPrefix + abs
+}
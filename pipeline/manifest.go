@@ -0,0 +1,69 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sort"
+	"time"
+
+	"criticalsys.net/hashcalcmt/hasher"
+)
+
+// Manifest is the outcome of a whole run, assembled in memory by Collect: the searched root,
+// the algorithms computed, and an entry per file sorted by path. Its fields carry JSON tags,
+// so that it can be serialized as is.
+type Manifest struct {
+	Root       string   `json:"root"`
+	Algorithms []string `json:"algorithms"`
+	Entries    []Entry  `json:"entries"`
+}
+
+// Entry is a file of a Manifest, with its path relative to the root. A file that was hashed has
+// its digests keyed by hash type, its size in bytes and its modification time; one that could
+// not be hashed has the message of the error instead. Link, Alias and Meta are set as described
+// for Result.
+type Entry struct {
+	Path    string            `json:"path"`
+	Hashes  map[string]string `json:"hashes,omitempty"`
+	Size    int64             `json:"size"`
+	ModTime time.Time         `json:"mtime,omitzero"`
+	Link    string            `json:"link,omitempty"`
+	Alias   string            `json:"alias,omitempty"`
+	Meta    *Metadata         `json:"metadata,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// Collect runs the pipeline like Run and assembles the results into a Manifest, for callers
+// that want the whole outcome rather than a stream of results. The errors of individual files
+// and directories are recorded in their entries, while an error preventing the whole run, such
+// as an unreadable root or the cancellation of ctx, is returned without a manifest.
+// The results are held in memory, so very large trees are better processed with Run.
+func Collect(ctx context.Context, opts Options, hf hasher.MultiFunc) (*Manifest, error) {
+	m := &Manifest{Root: opts.Path, Algorithms: []string{}, Entries: []Entry{}}
+	err := RunFunc(ctx, opts, hf, func(result Result) error {
+		if result.Error != nil && result.FilePath == "" {
+			return result.Error
+		}
+		if errors.Is(result.Error, context.Canceled) {
+			return nil // The cancellation is returned by RunFunc.
+		}
+		entry := Entry{Path: result.FilePath, Hashes: result.Hashes, Size: result.Size, ModTime: result.ModTime, Link: result.Link, Alias: result.Alias, Meta: result.Meta}
+		if result.Error != nil {
+			entry = Entry{Path: result.FilePath, Error: result.Error.Error()}
+		}
+		for hashType := range result.Hashes {
+			if !slices.Contains(m.Algorithms, hashType) {
+				m.Algorithms = append(m.Algorithms, hashType)
+			}
+		}
+		m.Entries = append(m.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(m.Algorithms)
+	sort.Slice(m.Entries, func(i, j int) bool { return m.Entries[i].Path < m.Entries[j].Path })
+	return m, nil
+}
@@ -0,0 +1,37 @@
+package pipeline
+
+import "os"
+
+// Metadata is the mode and ownership of a file, captured along with its digests when
+// Options.Metadata is set, so that a manifest also records the permissions of the tree.
+// UID and GID are -1 on the platforms without numeric file ownership, such as Windows.
+type Metadata struct {
+	Mode os.FileMode `json:"mode"`
+	UID  int         `json:"uid"`
+	GID  int         `json:"gid"`
+}
+
+// metadata returns the Metadata of a file from its attributes.
+func metadata(info os.FileInfo) *Metadata {
+	uid, gid, ok := fileOwner(info)
+	if !ok {
+		uid, gid = -1, -1
+	}
+	return &Metadata{Mode: info.Mode(), UID: uid, GID: gid}
+}
+
+// UnixMode returns the mode as the permission bits of chmod, including the setuid, setgid
+// and sticky bits, such as 0o644 or 0o4755.
+func (m *Metadata) UnixMode() uint32 {
+	mode := uint32(m.Mode.Perm())
+	if m.Mode&os.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if m.Mode&os.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if m.Mode&os.ModeSticky != 0 {
+		mode |= 0o1000
+	}
+	return mode
+}
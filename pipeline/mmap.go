@@ -0,0 +1,68 @@
+package pipeline
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"criticalsys.net/hashcalcmt/hasher"
+)
+
+// mmapChunkSize is the number of mapped bytes handed to the hash between two context checks.
+const mmapChunkSize = 4 << 20
+
+// hashMapped memory-maps the file and hashes the mapping.
+// It reports mapped as false when the file could not be mapped, so the caller can fall back to streaming.
+func hashMapped(ctx context.Context, file *os.File, size int64, hf hasher.MultiFunc) (hashes map[string]string, mapped bool, err error) {
+	data, unmap, err := mapFile(file, size)
+	if err != nil {
+		return nil, false, nil
+	}
+	defer func() {
+		if unmapErr := unmap(); err == nil {
+			err = unmapErr
+		}
+	}()
+	hashes, err = hf(&mappedReader{ctx: ctx, data: data})
+	return hashes, true, err
+}
+
+// mappedReader reads from a memory-mapped file.
+// It implements io.WriterTo so that io.Copy hands the mapped memory to the hash
+// without an intermediate copy, checking the context between chunks.
+type mappedReader struct {
+	ctx  context.Context
+	data []byte
+	off  int
+}
+
+// Read copies the next mapped bytes into p.
+func (mr *mappedReader) Read(p []byte) (int, error) {
+	if err := mr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if mr.off >= len(mr.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, mr.data[mr.off:])
+	mr.off += n
+	return n, nil
+}
+
+// WriteTo writes the remaining mapped bytes to w in chunks of mmapChunkSize.
+func (mr *mappedReader) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for mr.off < len(mr.data) {
+		if err := mr.ctx.Err(); err != nil {
+			return total, err
+		}
+		end := min(mr.off+mmapChunkSize, len(mr.data))
+		n, err := w.Write(mr.data[mr.off:end])
+		mr.off += n
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
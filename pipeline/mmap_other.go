@@ -0,0 +1,13 @@
+//go:build !unix
+
+package pipeline
+
+import (
+	"errors"
+	"os"
+)
+
+// mapFile is not supported on this platform, files are always streamed.
+func mapFile(*os.File, int64) ([]byte, func() error, error) {
+	return nil, nil, errors.ErrUnsupported
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package pipeline
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mapFile maps the whole file read-only into memory and hints the kernel for sequential access.
+// It returns the mapping and the function releasing it.
+func mapFile(file *os.File, size int64) ([]byte, func() error, error) {
+	data, err := unix.Mmap(int(file.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED) // #nosec G115 -- file descriptors fit in an int
+	if err != nil {
+		return nil, nil, err
+	}
+	_ = unix.Madvise(data, unix.MADV_SEQUENTIAL) // #nosec G104 -- the access pattern hint is optional
+	return data, func() error { return unix.Munmap(data) }, nil
+}
@@ -4,76 +4,331 @@
 package pipeline
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"criticalsys.net/hashcalcmt/hasher"
+	"golang.org/x/time/rate"
 )
 
 // Result represents a single file hashing result.
+// Hashes maps each requested hash type to the digest of the file,
+// Size is the number of bytes hashed, Duration the time spent reading and hashing them,
+// and ModTime the modification time of the file, which is zero when it is not known.
+// Reused is set when the digests were returned by Options.Reuse instead of reading the
+// file, in which case Size is the size of the file. Link is the target of a symbolic link
+// whose target path was hashed instead of its contents, as selected by Options.SymlinkPaths.
+// Alias is the path of another hard link to the same file, whose digests were reused instead
+// of reading it again, as selected by Options.Hardlinks. Meta is the mode and ownership of
+// the file, only captured with Options.Metadata. Changed is set by Options.Restat when the
+// size or the modification time of the file changed while it was read, in which case the
+// digests match neither its old nor its new contents.
 type Result struct {
 	FilePath string
-	Hash     string
+	Hashes   map[string]string
+	Size     int64
+	ModTime  time.Time
+	Duration time.Duration
+	Reused   bool
+	Link     string
+	Alias    string
+	Meta     *Metadata
+	Changed  bool
 	Error    error
 }
 
+// Options configures how the pipeline selects and processes files.
+type Options struct {
+	// Path is the root directory to search, or a single file to hash regardless of the
+	// selection options, in which case its parent directory is the root.
+	Path string
+	// FilePatterns are the globs file names are matched against; a file is hashed if any
+	// of them matches, or if there are none.
+	FilePatterns []string
+	// PatternFullPath matches FilePatterns against the slash-separated path relative to Path
+	// instead of the name, so that patterns can select directories such as "logs/*.txt".
+	PatternFullPath bool
+	// Regex, when set, replaces FilePatterns to select the files to hash.
+	Regex *regexp.Regexp
+	// RegexFullPath matches Regex against the slash-separated path relative to Path instead of the name.
+	RegexFullPath bool
+	// Excludes are globs matched against both the name and the path relative to Path.
+	// They take precedence over FilePatterns, and excluded directories are not descended into.
+	Excludes []string
+	// IgnoreCase matches FilePatterns and Excludes regardless of case, as on the file systems
+	// of Windows and macOS: both the patterns and the names are lowercased before matching.
+	IgnoreCase bool
+	// SkipHidden skips files and directories whose name starts with a dot.
+	// The name prefix is checked on every platform, not the Windows hidden attribute.
+	SkipHidden bool
+	// GitIgnore skips the files and directories matched by the .gitignore file of any directory
+	// above them, with the paths relative to that directory as git does. Negations re-include
+	// files excluded by the same .gitignore only, and files within an ignored directory
+	// cannot be re-included.
+	GitIgnore bool
+	// MinSize skips files smaller than this number of bytes.
+	MinSize int64
+	// MaxSize skips files larger than this number of bytes, unless it is 0.
+	MaxSize int64
+	// SkipEmpty skips the files of zero bytes, which all share the digest of empty input.
+	SkipEmpty bool
+	// ModifiedAfter skips files last modified before this time, unless it is zero.
+	ModifiedAfter time.Time
+	// ModifiedBefore skips files last modified after this time, unless it is zero.
+	ModifiedBefore time.Time
+	// MaxDepth limits the number of directory levels searched, unless it is 0.
+	// A value of 1 only searches the direct children of Path.
+	MaxDepth int
+	// FollowSymlinks descends into symbolic links to directories and filters linked files
+	// on the attributes of their target. Cycles are detected and skipped. Files are still
+	// opened through the root, so links resolving outside of Path are reported as errors.
+	FollowSymlinks bool
+	// SymlinkPaths hashes the target path of the symbolic links to files, as returned by
+	// os.Readlink, instead of the contents they point to, so that the digests reflect the
+	// structure of the tree. Links to directories are still descended into with FollowSymlinks.
+	SymlinkPaths bool
+	// NumWorkers is the number of hashing goroutines. A value of 0 or less picks it from the
+	// number of files, as described for AutoWorkers.
+	NumWorkers int
+	// MaxRate caps the total read throughput of all workers, in bytes per second,
+	// unless it is 0. Memory mapping is disabled while the rate is limited.
+	MaxRate int64
+	// IOConcurrency caps the number of files read simultaneously across all workers,
+	// unless it is 0. A low value avoids seek thrashing on spinning disks.
+	IOConcurrency int
+	// Mmap memory-maps files of at least MmapThreshold bytes and hashes the mapping
+	// directly, falling back to streaming when mapping fails or is unsupported.
+	Mmap bool
+	// MmapThreshold is the minimum size of a file to be memory-mapped, in bytes.
+	MmapThreshold int64
+	// Archives hashes the regular files stored in .zip, .tar, .tar.gz and .tgz files instead of
+	// the archives themselves, reporting each entry as "<archive>!/<entry>".
+	Archives bool
+	// Reuse, when set, is called before hashing a file with its path relative to Path, its size
+	// and its modification time. When it returns digests, they are reported instead of reading
+	// the file, which lets a caller skip the files unchanged since a previous run. It is called
+	// from the workers concurrently. Archive entries are always hashed.
+	Reuse func(rel string, size int64, modTime time.Time) (map[string]string, bool)
+	// BufferSize is the size of the read buffer of each worker, in bytes.
+	// Larger buffers reduce the number of read system calls, which mostly benefits
+	// network and spinning storage; 0 disables buffering.
+	BufferSize int
+	// Length caps the number of bytes hashed from each file, unless it is 0, so that the
+	// digests of longer files only cover their beginning. A device named by Path, whose
+	// reported size is usually 0, is read to its end unless capped by Length.
+	Length int64
+	// Tail hashes only the last Tail bytes of each file, unless it is 0, by seeking past the
+	// rest, so that the digests of longer files only cover their end. It cannot be combined
+	// with Length, and the files are streamed rather than memory-mapped.
+	Tail int64
+	// Fingerprint hashes the metadata of each file instead of its contents: its size, its
+	// modification time and, where available, its device and inode numbers, as formatted by
+	// fingerprint. No file is read, which makes it a quick way of detecting the files that
+	// probably changed, while a file modified without changing these is not detected.
+	Fingerprint bool
+	// Hardlinks hashes the files with several hard links once: the other paths of a file wait
+	// for its digests and report them with Result.Alias set, without reading it again. Files
+	// are identified by their device and inode numbers, so every path is hashed on the
+	// platforms that do not provide them, such as Windows.
+	Hardlinks bool
+	// Metadata captures the mode and ownership of each file in Result.Meta. The mode of a
+	// symbolic link hashed by its target path is the mode of the link.
+	Metadata bool
+	// Restat stats each file again once it is hashed and sets Result.Changed when its size or
+	// modification time differ from before the read, such as for a file being written to.
+	Restat bool
+	// MaxFiles stops queueing files once this many have been sent to the workers, unless it
+	// is 0: the walk is stopped and the files already queued are still hashed.
+	MaxFiles int
+	// CopyTo copies each file to this directory while it is hashed, unless it is empty, at
+	// the same path relative to it as the file relative to Path, so that the file is read
+	// once for both. The copies keep the permissions and modification time of the files. As
+	// every file is read in full, it cannot be combined with Length, Tail, Fingerprint,
+	// SymlinkPaths, Archives, Hardlinks or Reuse, and the files are not memory-mapped.
+	CopyTo string
+
+	// limiter is the rate limiter shared by the workers of a run, created from MaxRate.
+	limiter *rate.Limiter
+	// links tracks the files with several hard links, created from Hardlinks.
+	links *linkTable
+	// dest is the root of the copies, opened from CopyTo.
+	dest *os.Root
+}
+
+// Validate checks that all glob patterns of the options are well-formed
+// and that the size, time and file count bounds are consistent.
+func (o Options) Validate() error {
+	if o.Length > 0 && o.Tail > 0 {
+		return fmt.Errorf("length %d and tail %d cannot both be set", o.Length, o.Tail)
+	}
+	if o.CopyTo != "" && (o.Length > 0 || o.Tail > 0 || o.Fingerprint || o.SymlinkPaths || o.Archives || o.Hardlinks || o.Reuse != nil) {
+		return fmt.Errorf("copying to %s requires reading every file in full", o.CopyTo)
+	}
+	if o.MaxFiles < 0 {
+		return fmt.Errorf("maximum file count %d is negative", o.MaxFiles)
+	}
+	if o.MaxSize > 0 && o.MinSize > o.MaxSize {
+		return fmt.Errorf("minimum size %d is larger than maximum size %d", o.MinSize, o.MaxSize)
+	}
+	if !o.ModifiedAfter.IsZero() && !o.ModifiedBefore.IsZero() && o.ModifiedAfter.After(o.ModifiedBefore) {
+		return fmt.Errorf("modification window is empty: %s is after %s", o.ModifiedAfter.Format(time.RFC3339), o.ModifiedBefore.Format(time.RFC3339))
+	}
+	for _, pattern := range slices.Concat(o.FilePatterns, o.Excludes) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
 // Run starts the file processing pipeline.
 // It performs the following steps:
 // 1. Opens the target path as an os.Root to prevent directory traversal.
 // 2. Starts a pool of worker goroutines.
-// 3. Walks the directory tree and sends matching file paths to the workers.
+// 3. Walks the directory tree and sends matching file paths to the workers, up to MaxFiles.
 // 4. Closes all resources and channels once processing is complete.
+// It returns a read-only channel of Result objects. A directory that could not be read
+// yields a Result whose Error is a *WalkError, as the files below it were not hashed.
+// Cancelling ctx stops the walk and aborts the files being hashed; the
+// channel must still be drained until it is closed.
+func Run(ctx context.Context, opts Options, hf hasher.MultiFunc) <-chan Result {
+	if opts.NumWorkers <= 0 {
+		opts.NumWorkers = AutoWorkers(ctx, opts)
+	}
+	return start(ctx, opts, hf, func(jobs chan<- string, results chan<- Result) {
+		sent := 0
+		for rel, err := range Walk(ctx, opts) {
+			if err != nil {
+				results <- Result{FilePath: rel, Error: err}
+				continue
+			}
+			select {
+			case jobs <- rel:
+			case <-ctx.Done():
+				return
+			}
+			// Leaving the loop stops the walk.
+			if sent++; sent == opts.MaxFiles {
+				return
+			}
+		}
+	})
+}
+
+// RunFiles hashes an explicit list of files instead of walking the directory tree.
+// The file paths are relative to opts.Path, which is opened as an os.Root like in Run.
+// The selection options are not applied to the list, which is truncated to MaxFiles.
 // It returns a read-only channel of Result objects.
-func Run(path, filePattern string, numWorkers int, hf hasher.Func) <-chan Result {
+func RunFiles(ctx context.Context, opts Options, files []string, hf hasher.MultiFunc) <-chan Result {
+	if opts.MaxFiles > 0 && len(files) > opts.MaxFiles {
+		files = files[:opts.MaxFiles]
+	}
+	if opts.NumWorkers <= 0 {
+		opts.NumWorkers = WorkerCount(len(files))
+	}
+	return start(ctx, opts, hf, func(jobs chan<- string, _ chan<- Result) {
+		for _, file := range files {
+			select {
+			case jobs <- file:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// RunFunc runs the pipeline like Run and calls fn for every result from the calling goroutine,
+// so callers do not have to drain a channel. If fn returns an error, the remaining work is
+// cancelled and that error is returned once the workers have stopped. Otherwise RunFunc
+// returns the error of ctx, which is nil when all files were processed.
+func RunFunc(ctx context.Context, opts Options, hf hasher.MultiFunc, fn func(Result) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var fnErr error
+	for result := range Run(ctx, opts, hf) {
+		if fnErr != nil {
+			continue // Drain the results of the files aborted by the cancellation.
+		}
+		if err := fn(result); err != nil {
+			fnErr = err
+			cancel()
+		}
+	}
+	if fnErr != nil {
+		return fnErr
+	}
+	return ctx.Err()
+}
+
+// start opens the root, starts the worker pool and runs produce in its own goroutine
+// to feed the jobs channel. The jobs channel is closed once produce returns, and the
+// results channel is closed once all workers are done.
+func start(ctx context.Context, opts Options, hf hasher.MultiFunc, produce func(jobs chan<- string, results chan<- Result)) <-chan Result {
 	results := make(chan Result)
 	jobs := make(chan string)
 	var wg sync.WaitGroup
 
-	root, err := os.OpenRoot(path)
+	rootDir := RootDir(opts.Path)
+	root, err := os.OpenRoot(longPath(rootDir))
 	if err != nil {
-		results <- Result{Error: fmt.Errorf("error opening root %s: %w", path, err)}
-		close(results)
+		go func() {
+			results <- Result{Error: fmt.Errorf("error opening root %s: %w", rootDir, err)}
+			close(results)
+		}()
 		return results
 	}
 
+	if opts.MaxRate > 0 {
+		opts.limiter = newLimiter(opts.MaxRate)
+	}
+	if opts.Hardlinks {
+		opts.links = newLinkTable()
+	}
+	if opts.CopyTo != "" {
+		if opts.dest, err = openCopyRoot(opts.CopyTo); err != nil {
+			_ = root.Close() // #nosec G104 -- the copy error is reported instead
+			go func() {
+				results <- Result{Error: fmt.Errorf("error opening copy destination %s: %w", opts.CopyTo, err)}
+				close(results)
+			}()
+			return results
+		}
+	}
+
+	var sem semaphore
+	if opts.IOConcurrency > 0 {
+		sem = make(semaphore, opts.IOConcurrency)
+	}
+
 	// Start workers
-	for i := 0; i < numWorkers; i++ {
+	for i := 0; i < opts.NumWorkers; i++ {
 		wg.Add(1)
-		go worker(&wg, root, jobs, results, hf)
+		go worker(ctx, &wg, root, jobs, results, hf, sem, opts)
 	}
 
-	// Walk the directory and send jobs.
+	// Produce jobs.
 	go func() {
 		defer close(jobs)
-		if err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
-			if err != nil {
-				results <- Result{FilePath: p, Error: err}
-				return nil
-			}
-
-			if !info.IsDir() {
-				if match, _ := filepath.Match(filePattern, info.Name()); match {
-					// jobs channel expects path relative to root for os.Root access
-					rel, err := filepath.Rel(path, p)
-					if err != nil {
-						results <- Result{FilePath: p, Error: err}
-						return nil
-					}
-					jobs <- rel
-				}
-			}
-			return nil
-		}); err != nil {
-			results <- Result{Error: fmt.Errorf("error walking path %s: %w", path, err)}
-		}
+		produce(jobs, results)
 	}()
 
-	// Wait for all workers to finish, then close results channel and root.
+	// Wait for all workers to finish, then close results channel and roots.
 	go func() {
 		wg.Wait()
 		_ = root.Close() // #nosec G104 -- closing root at the end of processing, error is secondary to completion
+		if opts.dest != nil {
+			_ = opts.dest.Close() // #nosec G104 -- the copies are complete once the workers are done
+		}
 		close(results)
 	}()
 
@@ -81,22 +336,90 @@ func Run(path, filePattern string, numWorkers int, hf hasher.Func) <-chan Result
 }
 
 // worker is a goroutine that processes jobs from the jobs channel.
-// It uses the provided os.Root to safely open files and the hasher.Func to compute hashes.
+// It uses the provided os.Root to safely open files and the hasher.MultiFunc to compute hashes.
+// Each file is read while holding a slot of sem, which limits the concurrent reads.
 // Results are sent to the results channel.
-func worker(wg *sync.WaitGroup, root *os.Root, jobs <-chan string, results chan<- Result, hf hasher.Func) {
+func worker(ctx context.Context, wg *sync.WaitGroup, root *os.Root, jobs <-chan string, results chan<- Result, hf hasher.MultiFunc, sem semaphore, opts Options) {
 	defer wg.Done()
+	// The buffer is allocated once per worker and reset for every file.
+	var br *bufio.Reader
+	if opts.BufferSize > 0 {
+		br = bufio.NewReaderSize(nil, opts.BufferSize)
+	}
 	for filePath := range jobs {
-		hash, err := hashFile(root, filePath, hf)
-		results <- Result{FilePath: filePath, Hash: hash, Error: err}
+		if err := sem.acquire(ctx); err != nil {
+			results <- Result{FilePath: filePath, Error: err}
+			continue
+		}
+		if opts.Archives && isArchive(filePath) {
+			hashArchive(ctx, root, filePath, hf, opts.limiter, func(r Result) { results <- r })
+			sem.release()
+			continue
+		}
+		begin := time.Now()
+		result, err := hashFile(ctx, root, filePath, hf, br, opts)
+		result.Duration, result.Error = time.Since(begin), err
+		sem.release()
+		results <- result
+	}
+}
+
+// semaphore limits the number of concurrent operations to its capacity.
+// A nil semaphore does not limit anything.
+type semaphore chan struct{}
+
+// acquire waits for a free slot, or returns the context error once ctx is cancelled.
+func (s semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the slot taken by acquire.
+func (s semaphore) release() {
+	if s != nil {
+		<-s
 	}
 }
 
 // hashFile opens a file safely via the os.Root and computes its hash.
 // It ensures the file is closed correctly and handles any errors during the process.
-func hashFile(root *os.Root, filePath string, hf hasher.Func) (hash string, err error) {
+// Large files are memory-mapped when enabled by the options, other reads go through
+// br when it is not nil, and are copied to Options.CopyTo when set. Reads are aborted with
+// the context error once ctx is cancelled.
+// It returns a Result holding the digests, the number of bytes hashed and the modification time.
+func hashFile(ctx context.Context, root *os.Root, filePath string, hf hasher.MultiFunc, br *bufio.Reader, opts Options) (result Result, err error) {
+	result.FilePath = filePath
+	if opts.Fingerprint {
+		info, err := root.Stat(filePath)
+		if err != nil {
+			return result, err
+		}
+		result.ModTime, result.Size = info.ModTime(), info.Size()
+		if opts.Metadata {
+			result.Meta = metadata(info)
+		}
+		result.Hashes, err = hf(strings.NewReader(fingerprint(info)))
+		return result, err
+	}
+	if opts.SymlinkPaths {
+		if info, err := root.Lstat(filePath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			result, err := hashLink(root, filePath, info, hf)
+			if opts.Metadata {
+				result.Meta = metadata(info)
+			}
+			return result, err
+		}
+	}
 	file, err := root.Open(filePath)
 	if err != nil {
-		return "", fmt.Errorf("could not open file: %w", err)
+		return result, fmt.Errorf("could not open file: %w", err)
 	}
 	defer func() {
 		closeErr := file.Close()
@@ -105,5 +428,154 @@ func hashFile(root *os.Root, filePath string, hf hasher.Func) (hash string, err
 		}
 	}()
 
-	return hf(file)
+	info, err := file.Stat()
+	if err != nil {
+		return result, err
+	}
+	result.ModTime = info.ModTime()
+	if opts.Metadata {
+		result.Meta = metadata(info)
+	}
+
+	if opts.Reuse != nil {
+		if hashes, ok := opts.Reuse(filePath, info.Size(), info.ModTime()); ok {
+			result.Hashes, result.Size, result.Reused = hashes, info.Size(), true
+			return result, nil
+		}
+	}
+
+	if opts.Restat {
+		defer func() {
+			if err == nil && result.Alias == "" {
+				result.Changed = changedSince(root, filePath, info)
+			}
+		}()
+	}
+
+	if opts.links != nil {
+		if entry, first := opts.links.claim(info, filePath); entry != nil && first {
+			defer func() { entry.finish(result.Hashes, result.Size, err == nil) }()
+		} else if entry != nil {
+			select {
+			case <-entry.done:
+			case <-ctx.Done():
+				return result, ctx.Err()
+			}
+			// When hashing the first path failed, this one is hashed on its own.
+			if entry.ok {
+				result.Hashes, result.Size, result.Alias = entry.hashes, entry.size, entry.path
+				return result, nil
+			}
+		}
+	}
+
+	var copied *fileCopy
+	if opts.dest != nil {
+		if copied, err = createCopy(opts.dest, filePath, info.Mode().Perm()); err != nil {
+			return result, fmt.Errorf("could not create copy: %w", err)
+		}
+		defer func() {
+			if copyErr := copied.finish(err, info.ModTime()); err == nil && copyErr != nil {
+				err = fmt.Errorf("could not write copy: %w", copyErr)
+			}
+		}()
+	}
+
+	size := info.Size()
+	if opts.Length > 0 {
+		size = min(size, opts.Length)
+	}
+	if opts.Tail > 0 && size > opts.Tail {
+		if _, err := file.Seek(size-opts.Tail, io.SeekStart); err != nil {
+			return result, err
+		}
+		size = opts.Tail
+	}
+	if opts.Mmap && opts.limiter == nil && opts.Tail == 0 && copied == nil && size >= opts.MmapThreshold && size > 0 {
+		if hashes, mapped, err := hashMapped(ctx, file, size, hf); mapped {
+			result.Hashes, result.Size = hashes, size
+			return result, err
+		}
+	}
+
+	var r io.Reader = file
+	if br != nil {
+		br.Reset(file)
+		r = br
+	}
+	if opts.Length > 0 {
+		r = io.LimitReader(r, opts.Length)
+	}
+	if copied != nil {
+		r = io.TeeReader(r, copied)
+	}
+	cr := &contextReader{ctx: ctx, r: r, limiter: opts.limiter}
+	result.Hashes, err = hf(cr)
+	result.Size = cr.n
+	return result, err
+}
+
+// changedSince reports whether a file changed since its attributes were taken: its size or
+// its modification time differ, or it can no longer be stat'ed, such as once removed.
+func changedSince(root *os.Root, filePath string, before os.FileInfo) bool {
+	after, err := root.Stat(filePath)
+	return err != nil || after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime())
+}
+
+// fingerprint returns the metadata hashed by Options.Fingerprint, as the line
+// "<size> <mtime> <device> <inode>\n", with the modification time in nanoseconds since the
+// Unix epoch. The device and inode numbers are 0 on the platforms that do not provide them.
+func fingerprint(info os.FileInfo) string {
+	dev, ino, _ := fileID(info)
+	return fmt.Sprintf("%d %d %d %d\n", info.Size(), info.ModTime().UnixNano(), dev, ino)
+}
+
+// hashLink hashes the target path of a symbolic link rather than the contents it points to.
+// The size is the length of the target path, and the modification time that of the link.
+func hashLink(root *os.Root, filePath string, info os.FileInfo, hf hasher.MultiFunc) (Result, error) {
+	result := Result{FilePath: filePath, ModTime: info.ModTime()}
+	target, err := root.Readlink(filePath)
+	if err != nil {
+		return result, err
+	}
+	result.Link, result.Size = target, int64(len(target))
+	result.Hashes, err = hf(strings.NewReader(target))
+	return result, err
+}
+
+// maxBurst bounds the burst of the rate limiter, and therefore the size of a single throttled read.
+const maxBurst = 1 << 20
+
+// newLimiter creates a limiter allowing bytesPerSecond, with a burst of at most one second of reads.
+func newLimiter(bytesPerSecond int64) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(min(bytesPerSecond, maxBurst)))
+}
+
+// contextReader wraps an io.Reader and fails reads once its context is done,
+// so a cancellation interrupts the hashing of a large file between two reads.
+// It also counts the bytes read, and throttles the reads when limiter is not nil.
+type contextReader struct {
+	ctx     context.Context
+	r       io.Reader
+	n       int64
+	limiter *rate.Limiter
+}
+
+// Read returns the context error if the context is done, otherwise reads from the underlying reader.
+// With a limiter, reads are capped to its burst and wait until the bytes read are allowed.
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if cr.limiter != nil && len(p) > cr.limiter.Burst() {
+		p = p[:cr.limiter.Burst()]
+	}
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	if cr.limiter != nil && n > 0 {
+		if waitErr := cr.limiter.WaitN(cr.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
 }
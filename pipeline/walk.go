@@ -0,0 +1,441 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"iter"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	ignore "github.com/sabhiram/go-gitignore"
+)
+
+// errStopWalk stops the walk of Walk once its consumer stops iterating.
+var errStopWalk = errors.New("iteration stopped")
+
+// Walk returns an iterator over the paths, relative to opts.Path, of the files selected by the
+// options, in the order a walk finds them, without reading any file contents. Run hashes the
+// files it yields. Errors on individual entries are yielded with the path of the entry, a
+// directory that could not be read with a *WalkError, and an error stopping the whole walk
+// last, with an empty path. The walk stops once the consumer breaks out of
+// the loop or ctx is cancelled, without yielding the cancellation.
+func Walk(ctx context.Context, opts Options) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		stopped := false
+		err := walk(ctx, opts, func(rel string, _ fs.FileInfo) error {
+			if stopped || !yield(rel, nil) {
+				stopped = true
+				return errStopWalk
+			}
+			return ctx.Err()
+		}, func(r Result) {
+			if !stopped && !yield(r.FilePath, r.Error) {
+				stopped = true
+			}
+		})
+		if err != nil && !stopped && ctx.Err() == nil {
+			yield("", fmt.Errorf("error walking path %s: %w", opts.Path, err))
+		}
+	}
+}
+
+// Count walks the directory tree like Run and returns the number of files that would be hashed.
+// It reads no file contents, which makes it suitable for a quick pre-scan.
+func Count(ctx context.Context, opts Options) (int, error) {
+	n := 0
+	err := walk(ctx, opts, func(string, fs.FileInfo) error {
+		n++
+		return nil
+	}, func(Result) {})
+	return n, err
+}
+
+// gitignoreName is the name of the files holding the ignore rules of their directory.
+const gitignoreName = ".gitignore"
+
+// errEnoughFiles stops the walk of AutoWorkers once there is a file for every CPU.
+var errEnoughFiles = errors.New("enough files")
+
+// AutoWorkers returns a worker count suited to the files selected by opts: one worker per CPU,
+// but no more than the number of files, so that a small run does not start idle workers.
+// Hashing is CPU-bound on local storage, where more workers than CPUs bring nothing; on slow
+// storage, the concurrent reads are better limited with IOConcurrency. The walk stops as soon
+// as there is a file for every CPU, and its errors are left to the walk of Run to report.
+func AutoWorkers(ctx context.Context, opts Options) int {
+	n, cpus := 0, runtime.NumCPU()
+	_ = walk(ctx, opts, func(string, fs.FileInfo) error { // #nosec G104 -- errors are reported by the walk of Run
+		if n++; n >= cpus {
+			return errEnoughFiles
+		}
+		return nil
+	}, func(Result) {})
+	return WorkerCount(n)
+}
+
+// WorkerCount returns the worker count picked for a number of files: one worker per CPU,
+// but no more than the number of files, and at least one.
+func WorkerCount(files int) int {
+	return max(1, min(files, runtime.NumCPU()))
+}
+
+// List walks the directory tree like Run and calls fn with the path, relative to opts.Path,
+// and the size of every file that would be hashed, without reading any file contents. The size
+// of a symbolic link is the size of its target, unless SymlinkPaths hashes its target path.
+// Errors on individual entries are passed to fn as a Result carrying the error.
+func List(ctx context.Context, opts Options, fn func(Result)) error {
+	return walk(ctx, opts, func(rel string, info fs.FileInfo) error {
+		if info.Mode()&os.ModeSymlink != 0 && !opts.SymlinkPaths {
+			target, err := os.Stat(longPath(filepath.Join(RootDir(opts.Path), rel)))
+			if err != nil {
+				fn(Result{FilePath: rel, Error: err})
+				return nil
+			}
+			info = target
+		}
+		fn(Result{FilePath: rel, Size: info.Size()})
+		return nil
+	}, fn)
+}
+
+// Select returns the files of a list, relative to opts.Path, that a walk would select:
+// neither the files nor their parent directories are excluded or hidden, and the files match
+// the patterns, the depth limit and the size and time bounds. GitIgnore and FollowSymlinks only
+// apply to walks. Files that cannot be stat'ed are kept, so that hashing them reports the error.
+// The selection can be passed to RunFiles to process an explicit list like a walk.
+func Select(opts Options, files []string) []string {
+	var selection []string
+	for _, rel := range files {
+		info, err := os.Stat(longPath(filepath.Join(opts.Path, rel)))
+		if err != nil {
+			selection = append(selection, rel)
+			continue
+		}
+		if !listedDirsSelected(opts, rel) || (opts.MaxDepth > 0 && depth(rel) > opts.MaxDepth) {
+			continue
+		}
+		name := filepath.Base(rel)
+		if excluded(opts, name, rel) || (opts.SkipHidden && hidden(name)) {
+			continue
+		}
+		if selected(opts, name, rel) && inSizeRange(opts, info.Size()) && inTimeWindow(opts, info.ModTime()) {
+			selection = append(selection, rel)
+		}
+	}
+	return selection
+}
+
+// listedDirsSelected reports whether none of the parent directories of a listed file is
+// excluded or hidden, as a walk would not have descended into them.
+func listedDirsSelected(opts Options, rel string) bool {
+	for dir := filepath.Dir(rel); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		name := filepath.Base(dir)
+		if excluded(opts, name, dir) || (opts.SkipHidden && hidden(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// WalkError reports a directory whose entries could not be read, such as for lack of permission.
+// Unlike the error of a single file, it means that a whole subtree was skipped by the walk.
+type WalkError struct {
+	Path string
+	Err  error
+}
+
+// Error formats the error with its cause, which names the directory.
+func (e *WalkError) Error() string {
+	return "cannot read directory: " + e.Err.Error()
+}
+
+// Unwrap returns the underlying cause.
+func (e *WalkError) Unwrap() error {
+	return e.Err
+}
+
+// walk traverses the directory tree rooted at opts.Path and calls visit with the path,
+// relative to the root, and the attributes of every file selected by the options. The
+// attributes are those of the target of a followed symbolic link, and otherwise of the entry.
+// Errors on individual entries are passed to report and do not stop the walk; the directories
+// that could not be read are reported with a *WalkError.
+// The walk stops with the context error once ctx is cancelled, or with the first error returned by visit.
+// When opts.Path names a file rather than a directory, that file alone is visited, relative to
+// its parent directory, whatever the selection options: they only select files within a directory.
+func walk(ctx context.Context, opts Options, visit func(rel string, info fs.FileInfo) error, report func(Result)) error {
+	if info, err := os.Stat(longPath(opts.Path)); err == nil && !info.IsDir() {
+		return visit(filepath.Base(opts.Path), info)
+	}
+	// The extended-length form of the root carries over to every path of the walk.
+	base := longPath(opts.Path)
+	w := &walker{ctx: ctx, opts: opts, visit: visit, report: report, ignores: make(map[string]*ignore.GitIgnore)}
+	if opts.FollowSymlinks {
+		root, err := filepath.EvalSymlinks(base)
+		if err != nil {
+			return err
+		}
+		w.chain = []string{root}
+	}
+	return w.walk(base, "")
+}
+
+// RootDir returns the directory opened as the root of the pipeline for a path: the path itself
+// when it is a directory, or its parent directory when it names a single file.
+func RootDir(path string) string {
+	if isFile(path) {
+		return filepath.Dir(path)
+	}
+	return path
+}
+
+// isFile reports whether path exists and is not a directory, following symbolic links.
+func isFile(path string) bool {
+	info, err := os.Stat(longPath(path))
+	return err == nil && !info.IsDir()
+}
+
+// walker holds the state of a single directory traversal.
+// When symbolic links are followed, chain holds the resolved root followed by the
+// resolved targets of the links being descended into, so that a link cycle is detected
+// instead of making the walk loop forever. With GitIgnore, ignores holds the compiled
+// .gitignore of the directories visited, keyed by their slash-separated relative path.
+type walker struct {
+	ctx     context.Context
+	opts    Options
+	visit   func(rel string, info fs.FileInfo) error
+	report  func(Result)
+	chain   []string
+	ignores map[string]*ignore.GitIgnore
+}
+
+// walk traverses the tree rooted at base, whose entries are reported relative to
+// the root as relBase joined with their path below base.
+func (w *walker) walk(base, relBase string) error {
+	return filepath.Walk(base, func(p string, info os.FileInfo, err error) error {
+		if ctxErr := w.ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil && (info == nil || !info.IsDir()) {
+			w.report(Result{FilePath: p, Error: err})
+			return nil
+		}
+		// A directory whose entries could not be read is only reported once it is known to be
+		// selected: an excluded directory, or one beyond the depth limit, would be skipped anyway.
+		if p == base && info.IsDir() {
+			if err != nil {
+				w.report(Result{FilePath: p, Error: &WalkError{Path: p, Err: err}})
+				return nil
+			}
+			if w.opts.GitIgnore {
+				w.loadIgnore(p, relBase)
+			}
+			return nil
+		}
+
+		// visit expects path relative to root for os.Root access
+		rel, relErr := filepath.Rel(base, p)
+		if relErr != nil {
+			w.report(Result{FilePath: p, Error: relErr})
+			return nil
+		}
+		rel = filepath.Join(relBase, rel)
+
+		if excluded(w.opts, info.Name(), rel) || (w.opts.SkipHidden && hidden(info.Name())) ||
+			(w.opts.GitIgnore && w.ignored(rel, info.IsDir())) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if w.opts.FollowSymlinks && info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Stat(p)
+			if err != nil {
+				w.report(Result{FilePath: rel, Error: err})
+				return nil
+			}
+			if target.IsDir() {
+				return w.walkLink(p, rel)
+			}
+			// Filter linked files on the attributes of their target.
+			info = target
+		}
+
+		// Entries directly under the root are at level 1.
+		if info.IsDir() && w.opts.MaxDepth > 0 && depth(rel) >= w.opts.MaxDepth {
+			return filepath.SkipDir
+		}
+		if info.IsDir() && err != nil {
+			w.report(Result{FilePath: p, Error: &WalkError{Path: p, Err: err}})
+			return nil
+		}
+		if info.IsDir() && w.opts.GitIgnore {
+			w.loadIgnore(p, rel)
+		}
+
+		// Devices, named pipes and sockets are only read when named by Path: a device could be
+		// huge or endless, and reading a pipe could block the walk forever.
+		if special(info) {
+			return nil
+		}
+		if !info.IsDir() && selected(w.opts, info.Name(), rel) &&
+			inSizeRange(w.opts, info.Size()) && inTimeWindow(w.opts, info.ModTime()) {
+			return w.visit(rel, info)
+		}
+		return nil
+	})
+}
+
+// walkLink descends into the directory targeted by the symbolic link at p, unless the
+// depth limit is reached, the target lies outside of the root, or following it would loop.
+func (w *walker) walkLink(p, rel string) error {
+	if w.opts.MaxDepth > 0 && depth(rel) >= w.opts.MaxDepth {
+		return nil
+	}
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		w.report(Result{FilePath: rel, Error: err})
+		return nil
+	}
+	if !within(real, w.chain[0]) {
+		w.report(Result{FilePath: rel, Error: fmt.Errorf("symbolic link target %s is outside of the root", real)})
+		return nil
+	}
+	// A target that is being descended into, or that contains the link itself, is a cycle.
+	parent, err := filepath.EvalSymlinks(filepath.Dir(p))
+	if err != nil || within(parent, real) || slices.Contains(w.chain, real) {
+		return nil
+	}
+	w.chain = append(w.chain, real)
+	defer func() { w.chain = w.chain[:len(w.chain)-1] }()
+	return w.walk(real, rel)
+}
+
+// loadIgnore compiles the .gitignore file of the directory at p, whose path relative to the
+// root is rel. A directory without one is skipped silently, and an unreadable one is reported.
+func (w *walker) loadIgnore(p, rel string) {
+	gi, err := ignore.CompileIgnoreFile(filepath.Join(p, gitignoreName))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			w.report(Result{FilePath: filepath.Join(rel, gitignoreName), Error: err})
+		}
+		return
+	}
+	w.ignores[path.Clean(filepath.ToSlash(rel))] = gi
+}
+
+// ignored reports whether an entry is matched by the .gitignore of any directory above it,
+// with its path relative to that directory. Directories are matched with a trailing slash,
+// so that patterns such as "build/" only apply to them.
+func (w *walker) ignored(rel string, isDir bool) bool {
+	name := filepath.ToSlash(rel)
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		if gi := w.ignores[dir]; gi != nil {
+			sub := name
+			if dir != "." {
+				sub = strings.TrimPrefix(name, dir+"/")
+			}
+			if isDir {
+				sub += "/"
+			}
+			if gi.MatchesPath(sub) {
+				return true
+			}
+		}
+		if dir == "." {
+			return false
+		}
+	}
+}
+
+// special reports whether an entry is a device, a named pipe, a socket or another irregular file.
+// Symbolic links are not special, as they are only resolved when followed or opened.
+func special(info os.FileInfo) bool {
+	return info.Mode()&(os.ModeDevice|os.ModeCharDevice|os.ModeNamedPipe|os.ModeSocket|os.ModeIrregular) != 0
+}
+
+// within reports whether path is dir or one of its descendants.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// selected reports whether a file is selected by the regular expression when set,
+// or by any of the file patterns otherwise.
+func selected(opts Options, name, rel string) bool {
+	if opts.Regex != nil {
+		if opts.RegexFullPath {
+			return opts.Regex.MatchString(filepath.ToSlash(rel))
+		}
+		return opts.Regex.MatchString(name)
+	}
+	if len(opts.FilePatterns) == 0 {
+		return true
+	}
+	for _, pattern := range opts.FilePatterns {
+		var match bool
+		if opts.PatternFullPath {
+			// path.Match always separates on "/", so a "*" never crosses a directory, on every platform.
+			match, _ = path.Match(foldCase(opts, pattern), foldCase(opts, filepath.ToSlash(rel)))
+		} else {
+			match, _ = filepath.Match(foldCase(opts, pattern), foldCase(opts, name))
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// depth returns the directory level of a relative path, 1 being the direct children of the root.
+func depth(rel string) int {
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+// inSizeRange reports whether a file size is within the optional size bounds, leaving out
+// empty files with SkipEmpty.
+func inSizeRange(opts Options, size int64) bool {
+	return size >= opts.MinSize && (opts.MaxSize == 0 || size <= opts.MaxSize) && (size > 0 || !opts.SkipEmpty)
+}
+
+// inTimeWindow reports whether a modification time is within the optional time window.
+func inTimeWindow(opts Options, modTime time.Time) bool {
+	if !opts.ModifiedAfter.IsZero() && modTime.Before(opts.ModifiedAfter) {
+		return false
+	}
+	return opts.ModifiedBefore.IsZero() || !modTime.After(opts.ModifiedBefore)
+}
+
+// hidden reports whether a name denotes a hidden entry by the Unix dot-prefix convention.
+func hidden(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// excluded reports whether the name or the relative path of an entry matches any exclude pattern.
+func excluded(opts Options, name, rel string) bool {
+	for _, pattern := range opts.Excludes {
+		pattern = foldCase(opts, pattern)
+		if match, _ := filepath.Match(pattern, foldCase(opts, name)); match {
+			return true
+		}
+		if match, _ := filepath.Match(pattern, foldCase(opts, rel)); match {
+			return true
+		}
+	}
+	return false
+}
+
+// foldCase lowercases a pattern or a name matched against one with IgnoreCase, and otherwise
+// returns it as is.
+func foldCase(opts Options, s string) string {
+	if opts.IgnoreCase {
+		return strings.ToLower(s)
+	}
+	return s
+}
@@ -0,0 +1,101 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestSelectExcludes checks the selection of files by Walk and Select: --exclude takes
+// precedence over --file-pattern, matches the name or the relative path of an entry, and
+// leaves out whole directories.
+func TestSelectExcludes(t *testing.T) {
+	root := t.TempDir()
+	files := []string{
+		"a.txt",
+		"b.log",
+		"B.TXT",
+		filepath.Join("sub", "c.txt"),
+		filepath.Join("sub", "d.log"),
+		filepath.Join("skip", "e.txt"),
+		filepath.Join("deep", "sub", "f.txt"),
+	}
+	for _, rel := range files {
+		path := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(rel), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		patterns   []string
+		excludes   []string
+		ignoreCase bool
+		want       []string
+	}{
+		{
+			name: "no filters",
+			want: files,
+		},
+		{
+			name:     "exclude by name wins over pattern",
+			patterns: []string{"*.txt"},
+			excludes: []string{"c.txt"},
+			want:     []string{"a.txt", filepath.Join("skip", "e.txt"), filepath.Join("deep", "sub", "f.txt")},
+		},
+		{
+			name:     "exclude by relative path",
+			excludes: []string{filepath.Join("sub", "*.log")},
+			want:     slices.DeleteFunc(slices.Clone(files), func(rel string) bool { return rel == filepath.Join("sub", "d.log") }),
+		},
+		{
+			name:     "exclude a directory by name at any depth",
+			patterns: []string{"*.txt"},
+			excludes: []string{"sub", "skip"},
+			want:     []string{"a.txt"},
+		},
+		{
+			name:     "exclude a directory by relative path only",
+			patterns: []string{"*.txt"},
+			excludes: []string{filepath.Join("deep", "sub")},
+			want:     []string{"a.txt", filepath.Join("sub", "c.txt"), filepath.Join("skip", "e.txt")},
+		},
+		{
+			name:     "case-sensitive exclude",
+			excludes: []string{"*.txt"},
+			want:     []string{"b.log", "B.TXT", filepath.Join("sub", "d.log")},
+		},
+		{
+			name:       "case-insensitive exclude",
+			excludes:   []string{"*.txt"},
+			ignoreCase: true,
+			want:       []string{"b.log", filepath.Join("sub", "d.log")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := Options{Path: root, FilePatterns: tt.patterns, Excludes: tt.excludes, IgnoreCase: tt.ignoreCase}
+			want := slices.Sorted(slices.Values(tt.want))
+
+			if got := slices.Sorted(slices.Values(Select(opts, files))); !slices.Equal(got, want) {
+				t.Errorf("Select = %v, want %v", got, want)
+			}
+			var walked []string
+			for rel, err := range Walk(context.Background(), opts) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				walked = append(walked, rel)
+			}
+			if got := slices.Sorted(slices.Values(walked)); !slices.Equal(got, want) {
+				t.Errorf("Walk = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"criticalsys.net/hashcalcmt/hasher"
+)
+
+// progressInterval is the refresh period of the progress line.
+const progressInterval = 500 * time.Millisecond
+
+// spinnerFrames are displayed while the total number of files is still unknown.
+var spinnerFrames = []string{"|", "/", "-", "\\"}
+
+// progress tracks and periodically reports the number of files and bytes hashed.
+// The bytes are counted concurrently by the workers through the wrapped hash function, and
+// the files as their results are processed, so that the files reused from the cache or from
+// another hard link count as well.
+type progress struct {
+	files atomic.Int64
+	bytes atomic.Int64
+	total atomic.Int64 // Total number of files, or -1 while unknown.
+	start time.Time
+	w     io.Writer
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// newProgress creates a progress reporter writing to w. The total is initially unknown.
+func newProgress(w io.Writer) *progress {
+	p := &progress{w: w, done: make(chan struct{})}
+	p.total.Store(-1)
+	return p
+}
+
+// wrap returns a hash function that counts the bytes read by hf.
+func (p *progress) wrap(hf hasher.MultiFunc) hasher.MultiFunc {
+	return func(r io.Reader) (map[string]string, error) {
+		return hf(&countingReader{r: r, n: &p.bytes})
+	}
+}
+
+// fileDone counts a file whose result was processed, successful or not.
+func (p *progress) fileDone() {
+	p.files.Add(1)
+}
+
+// setTotal records the total number of files once the pre-scan is complete.
+func (p *progress) setTotal(total int) {
+	p.total.Store(int64(total))
+}
+
+// run starts the periodic reporting goroutine.
+func (p *progress) run() {
+	p.start = time.Now()
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for frame := 0; ; frame++ {
+			select {
+			case <-ticker.C:
+				p.print(spinnerFrames[frame%len(spinnerFrames)])
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop ends the reporting goroutine and prints the final progress line.
+func (p *progress) stop() {
+	close(p.done)
+	p.wg.Wait()
+	p.print(" ")
+	_, _ = fmt.Fprintln(p.w) // #nosec G104 -- progress output is best effort
+}
+
+// print overwrites the current progress line with the latest counters.
+// The percentage is shown once the total is known, otherwise the spinner frame is shown.
+func (p *progress) print(spinner string) {
+	files, bytes, total := p.files.Load(), p.bytes.Load(), p.total.Load()
+	elapsed := time.Since(p.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(bytes) / elapsed / 1e6
+	}
+	status := spinner
+	counted := fmt.Sprintf("%d files", files)
+	if total >= 0 {
+		pct := 100.0
+		if total > 0 {
+			pct = float64(files) * 100 / float64(total)
+		}
+		status = fmt.Sprintf("%5.1f%%", pct)
+		counted = fmt.Sprintf("%d/%d files", files, total)
+	}
+	// The trailing spaces clear leftovers of a previous, longer line.
+	_, _ = fmt.Fprintf(p.w, "\r%s %s, %s, %.1f MB/s   ", status, counted, formatBytes(bytes), rate) // #nosec G104 -- progress output is best effort
+}
+
+// countingReader adds the number of bytes read to a shared counter.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+// Read reads from the underlying reader and accounts for the bytes read.
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.n.Add(int64(n))
+	return n, err
+}
+
+// WriteTo preserves the io.WriterTo fast path of the underlying reader, such as a
+// memory mapping, by counting the bytes on the writing side instead.
+func (cr *countingReader) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(&countingWriter{w: w, n: cr.n}, cr.r)
+}
+
+// countingWriter adds the number of bytes written to a shared counter.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+// Write writes to the underlying writer and accounts for the bytes written.
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"criticalsys.net/hashcalcmt/hasher"
+	"criticalsys.net/hashcalcmt/pipeline"
+)
+
+// isURL reports whether a --path or a --files-from entry is an http or https URL, hashed by
+// downloading it rather than read from the file system.
+func isURL(path string) bool {
+	lower := strings.ToLower(path)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// hashURLs downloads the URLs with the given number of workers and hashes the response bodies
+// as they are received, without saving them. Each URL is reported as a result named after it;
+// a response with a status other than 2xx is reported as the error of its result. timeout
+// limits each request, including the download of its body, unless it is 0, and only the first
+// length bytes of each body are hashed when length is positive, as with --length.
+func hashURLs(ctx context.Context, urls []string, hf hasher.MultiFunc, timeout time.Duration, length int64, workers int) <-chan pipeline.Result {
+	client := &http.Client{Timeout: timeout}
+	jobs := make(chan string)
+	results := make(chan pipeline.Result)
+	var wg sync.WaitGroup
+	for range max(min(workers, len(urls)), 1) {
+		wg.Go(func() {
+			for url := range jobs {
+				results <- hashURL(ctx, client, url, hf, length)
+			}
+		})
+	}
+	go func() {
+		defer close(jobs)
+		for _, url := range urls {
+			select {
+			case jobs <- url:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// hashURL downloads and hashes a single URL, stopping after length bytes when it is positive.
+func hashURL(ctx context.Context, client *http.Client, url string, hf hasher.MultiFunc, length int64) pipeline.Result {
+	result := pipeline.Result{FilePath: url}
+	begin := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+	defer func() { _ = resp.Body.Close() }() // #nosec G104 -- the body has been read
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		result.Error = fmt.Errorf("GET %s: %s", url, resp.Status)
+		return result
+	}
+	var body io.Reader = resp.Body
+	if length > 0 {
+		body = io.LimitReader(body, length)
+	}
+	var size atomic.Int64
+	result.Hashes, result.Error = hf(&countingReader{r: body, n: &size})
+	result.Size, result.Duration = size.Load(), time.Since(begin)
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		result.ModTime = t
+	}
+	return result
+}
+
+// mergeResults forwards the results of several channels to a single one, closed once they
+// are all closed.
+func mergeResults(channels ...<-chan pipeline.Result) <-chan pipeline.Result {
+	merged := make(chan pipeline.Result)
+	var wg sync.WaitGroup
+	for _, ch := range channels {
+		wg.Go(func() {
+			for result := range ch {
+				merged <- result
+			}
+		})
+	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+	return merged
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"criticalsys.net/hashcalcmt/pipeline"
+)
+
+// defaultRenameTemplate renames a file to its hash in its own directory, keeping the extension.
+const defaultRenameTemplate = "{dir}/{hash}{ext}"
+
+// Behaviors of --rename when the destination already exists, selected by --on-collision.
+const (
+	collisionError     = "error"
+	collisionSkip      = "skip"
+	collisionOverwrite = "overwrite"
+)
+
+// templatePlaceholder matches a "{name}" or "{name:length}" placeholder of a rename template.
+var templatePlaceholder = regexp.MustCompile(`\{(\w+)(?::(\d+))?\}`)
+
+// renamer renames hashed files according to a template. Files are renamed through the root
+// of --path, so the paths of the results are relative to it. The rendered template is relative
+// to the destination root, which is the same root unless --rename-dir moves the files to
+// another directory, and the destination cannot escape it.
+type renamer struct {
+	root        *os.Root
+	dest        *os.Root
+	template    string
+	onCollision string
+	// renameFile renames a file within the root. It is replaceable so that a rename across
+	// file systems can be simulated.
+	renameFile func(oldPath, newPath string) error
+}
+
+// newRenamer opens the roots of the renames and validates the template and the collision
+// behavior. The destination directory dir is created if needed; when empty, files are renamed
+// within the root of path.
+func newRenamer(path, dir, template, onCollision string) (*renamer, error) {
+	if err := validateTemplate(template); err != nil {
+		return nil, err
+	}
+	switch onCollision {
+	case collisionError, collisionSkip, collisionOverwrite:
+	default:
+		return nil, fmt.Errorf("unsupported collision behavior: %s", onCollision)
+	}
+	root, err := os.OpenRoot(pipeline.RootDir(path))
+	if err != nil {
+		return nil, err
+	}
+	r := &renamer{root: root, dest: root, template: template, onCollision: onCollision}
+	r.renameFile = root.Rename
+	if dir != "" {
+		err := os.MkdirAll(dir, 0o750)
+		if err == nil {
+			r.dest, err = os.OpenRoot(dir)
+		}
+		if err != nil {
+			_ = root.Close() // #nosec G104 -- the error of the destination is reported instead
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// validateTemplate checks that a rename template only uses the supported placeholders:
+// {hash}, {hash:N}, {name}, {ext} and {dir}.
+func validateTemplate(template string) error {
+	for _, m := range templatePlaceholder.FindAllStringSubmatch(template, -1) {
+		switch {
+		case m[1] == "hash" && m[2] != "":
+			if n, err := strconv.Atoi(m[2]); err != nil || n == 0 {
+				return fmt.Errorf("invalid rename template placeholder %s: the length must be positive", m[0])
+			}
+		case m[1] == "hash" || m[1] == "name" || m[1] == "ext" || m[1] == "dir":
+			if m[2] != "" {
+				return fmt.Errorf("invalid rename template placeholder %s: only {hash} accepts a length", m[0])
+			}
+		default:
+			return fmt.Errorf("unknown rename template placeholder %s", m[0])
+		}
+	}
+	return nil
+}
+
+// render returns the destination of a file from the template. {hash} is the digest, {hash:N}
+// its first N characters, {name} the file name without its extension, {ext} the extension
+// including its dot, and {dir} the directory of the file relative to the root.
+func (r *renamer) render(filePath, hash string) string {
+	base := filepath.Base(filePath)
+	ext := filepath.Ext(base)
+	rendered := templatePlaceholder.ReplaceAllStringFunc(r.template, func(placeholder string) string {
+		m := templatePlaceholder.FindStringSubmatch(placeholder)
+		switch m[1] {
+		case "hash":
+			if n, err := strconv.Atoi(m[2]); err == nil && n < len(hash) {
+				return hash[:n]
+			}
+			return hash
+		case "name":
+			return strings.TrimSuffix(base, ext)
+		case "ext":
+			return ext
+		default:
+			return filepath.ToSlash(filepath.Dir(filePath))
+		}
+	})
+	return filepath.Clean(filepath.FromSlash(rendered))
+}
+
+// rename moves a file to the destination rendered from the template, creating the missing
+// directories. A file already at its destination is left as is. An existing destination is
+// reported as an error, leaves the file as is, or is replaced, depending on the collision behavior.
+// A file is moved to --rename-dir, or to a destination on another file system, by copying it.
+// No rename can go from one os.Root to another, and renaming through their names would follow
+// the symbolic links leading out of them.
+func (r *renamer) rename(filePath, hash string) error {
+	newPath := r.render(filePath, hash)
+	if r.dest == r.root && newPath == filepath.Clean(filePath) {
+		return nil
+	}
+	if _, err := r.dest.Lstat(newPath); err == nil {
+		switch r.onCollision {
+		case collisionSkip:
+			return nil
+		case collisionError:
+			return fmt.Errorf("%s: file already exists", newPath)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if dir := filepath.Dir(newPath); dir != "." {
+		if err := r.dest.MkdirAll(dir, 0o750); err != nil {
+			return err
+		}
+	}
+	if r.dest != r.root {
+		if !filepath.IsLocal(newPath) {
+			return fmt.Errorf("%s: path escapes from the destination directory", newPath)
+		}
+		return r.move(filePath, newPath)
+	}
+	err := r.renameFile(filePath, newPath)
+	if errors.Is(err, syscall.EXDEV) {
+		return r.move(filePath, newPath)
+	}
+	return err
+}
+
+// move moves a file to a destination of the destination root, which a rename cannot do when
+// it is the root of --rename-dir or a mount point lies within the root. The file is copied to a
+// temporary file next to the destination, synced to disk and renamed over it, and the original
+// is only removed once the copy is in place. A failed copy is removed and leaves the original
+// untouched.
+func (r *renamer) move(filePath, newPath string) (err error) {
+	src, err := r.root.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }() // #nosec G104 -- the file is only read
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := newPath + ".partial"
+	dst, err := r.dest.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = r.dest.Remove(tmpPath) // #nosec G104 -- the copy error is reported instead
+		}
+	}()
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = r.dest.Chmod(tmpPath, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err = r.dest.Chtimes(tmpPath, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	if err = r.dest.Rename(tmpPath, newPath); err != nil {
+		return err
+	}
+	return r.root.Remove(filePath)
+}
+
+// Close closes the roots of the renames.
+func (r *renamer) Close() error {
+	if r.dest != r.root {
+		_ = r.dest.Close() // #nosec G104 -- the root is only used for renames, which report their own errors
+	}
+	return r.root.Close()
+}
+
+// within reports whether path is dir or lies below it, comparing their absolute forms without
+// resolving symbolic links.
+func within(path, dir string) bool {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	return err == nil && filepath.IsLocal(rel)
+}
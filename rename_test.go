@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestRenameCrossDevice checks that a rename failing with EXDEV, as between two file systems,
+// falls back to copying the file to its destination and removing the original, keeping its
+// contents, permissions and modification time, and that a move to --rename-dir always copies.
+func TestRenameCrossDevice(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		withDir   bool
+		wantCalls int
+	}{
+		{"within --path", false, 1},
+		{"to --rename-dir", true, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			src := t.TempDir()
+			dir, destDir := "", src
+			if tt.withDir {
+				dir = t.TempDir()
+				destDir = dir
+			}
+			modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			if err := os.MkdirAll(filepath.Join(src, "sub"), 0o750); err != nil {
+				t.Fatal(err)
+			}
+			oldPath := filepath.Join(src, "sub", "photo.jpg")
+			if err := os.WriteFile(oldPath, []byte("contents"), 0o640); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(oldPath, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := newRenamer(src, dir, defaultRenameTemplate, collisionError)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = r.Close() }()
+			calls := 0
+			r.renameFile = func(string, string) error {
+				calls++
+				return &os.LinkError{Op: "rename", Err: syscall.EXDEV}
+			}
+
+			if err := r.rename(filepath.Join("sub", "photo.jpg"), "abc123"); err != nil {
+				t.Fatal(err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("rename attempted %d times, want %d", calls, tt.wantCalls)
+			}
+			if _, err := os.Stat(oldPath); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("original still present: %v", err)
+			}
+			newPath := filepath.Join(destDir, "sub", "abc123.jpg")
+			data, err := os.ReadFile(newPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "contents" {
+				t.Errorf("copied contents %q, want %q", data, "contents")
+			}
+			info, err := os.Stat(newPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !info.ModTime().Equal(modTime) {
+				t.Errorf("modification time %s, want %s", info.ModTime(), modTime)
+			}
+			if _, err := os.Stat(newPath + ".partial"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("temporary copy left behind: %v", err)
+			}
+		})
+	}
+}
+
+// TestRenameCrossDeviceFailedCopy checks that a failed copy leaves the original in place and
+// no partial copy behind.
+func TestRenameCrossDeviceFailedCopy(t *testing.T) {
+	src, dir := t.TempDir(), t.TempDir()
+	oldPath := filepath.Join(src, "photo.jpg")
+	if err := os.WriteFile(oldPath, []byte("contents"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	r, err := newRenamer(src, dir, defaultRenameTemplate, collisionError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close() }()
+	r.renameFile = func(string, string) error {
+		return &os.LinkError{Op: "rename", Err: syscall.EXDEV}
+	}
+	// A directory in place of the destination makes the final rename of the copy fail.
+	if err := os.MkdirAll(filepath.Join(dir, "abc123.jpg", "x"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	r.onCollision = collisionOverwrite
+
+	if err := r.rename("photo.jpg", "abc123"); err == nil {
+		t.Fatal("rename over a non-empty directory succeeded")
+	}
+	if _, err := os.Stat(oldPath); err != nil {
+		t.Errorf("original lost: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "abc123.jpg.partial")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("temporary copy left behind: %v", err)
+	}
+}
+
+// TestRenameDirSymlinkEscape checks that a move to --rename-dir does not follow a symbolic
+// link of the tree leading out of --path.
+func TestRenameDirSymlinkEscape(t *testing.T) {
+	src, dir, outside := t.TempDir(), t.TempDir(), t.TempDir()
+	outsidePath := filepath.Join(outside, "photo.jpg")
+	if err := os.WriteFile(outsidePath, []byte("contents"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(src, "link")); err != nil {
+		t.Skip("symbolic links not supported:", err)
+	}
+	r, err := newRenamer(src, dir, defaultRenameTemplate, collisionError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close() }()
+
+	if err := r.rename(filepath.Join("link", "photo.jpg"), "abc123"); err == nil {
+		t.Error("moved a file reached through a symbolic link out of --path")
+	}
+	if _, err := os.Stat(outsidePath); err != nil {
+		t.Errorf("file outside --path lost: %v", err)
+	}
+}
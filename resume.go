@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+
+	"criticalsys.net/hashcalcmt/pipeline"
+)
+
+// Suffixes of the sidecar files written next to --out-file when a run is interrupted.
+const (
+	partialSuffix   = ".partial"
+	remainingSuffix = ".remaining"
+)
+
+// writeSidecars writes the sidecar files of an interrupted run next to the output file: the
+// paths of the files completed, to <out-file>.partial, and the paths of the selected files
+// that were not, to <out-file>.remaining, one per line and relative to --path. The remaining
+// files are those of the --files-from list, or found by walking the tree again, so that a
+// follow-up run with --files-from=<out-file>.remaining --append completes the manifest.
+func writeSidecars(cfg *Config, done []string) error {
+	completed := make(map[string]bool, len(done))
+	for _, filePath := range done {
+		completed[filePath] = true
+	}
+	var remaining []string
+	if cfg.FilesFrom != "" {
+		for _, filePath := range cfg.files {
+			if !completed[filePath] {
+				remaining = append(remaining, filePath)
+			}
+		}
+	} else {
+		err := pipeline.List(context.Background(), cfg.pipelineOptions(), func(result pipeline.Result) {
+			if result.Error == nil && !completed[result.FilePath] {
+				remaining = append(remaining, result.FilePath)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := writeList(cfg.OutFile+partialSuffix, done); err != nil {
+		return err
+	}
+	return writeList(cfg.OutFile+remainingSuffix, remaining)
+}
+
+// writeList replaces a file with a list of paths, one per line.
+func writeList(name string, paths []string) error {
+	file, err := createAtomic(name)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(file)
+	for _, filePath := range paths {
+		if _, err = fmt.Fprintln(bw, filePath); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Commit()
+}
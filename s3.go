@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3Upload streams the output to an S3 object as it is written: the writes go through a pipe
+// read by the multipart uploader of the AWS SDK, so that no local copy of the manifest is
+// needed whatever its size. The object only appears once the upload completes, and a failed
+// write aborts the upload, leaving any previous object in place as with --out-file.
+type s3Upload struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+// parseS3URI splits an s3://bucket/key URI into its bucket and key.
+func parseS3URI(uri string) (bucket, key string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", err
+	}
+	key = strings.TrimPrefix(u.Path, "/")
+	if u.Scheme != "s3" || u.Host == "" || key == "" || strings.HasSuffix(key, "/") {
+		return "", "", fmt.Errorf("invalid --s3 %q: expected s3://bucket/key", uri)
+	}
+	return u.Host, key, nil
+}
+
+// openS3 starts the upload of the output to an s3://bucket/key URI, with the credentials and
+// the region of the default AWS chain: the environment, the shared config and credentials
+// files, and the role of the instance or container.
+func openS3(ctx context.Context, uri, contentType string) (*s3Upload, error) {
+	bucket, key, err := parseS3URI(uri)
+	if err != nil {
+		return nil, err
+	}
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	uploader := manager.NewUploader(s3.NewFromConfig(awsCfg))
+
+	pr, pw := io.Pipe()
+	u := &s3Upload{pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := uploader.Upload(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(key),
+			Body:        pr,
+			ContentType: aws.String(contentType),
+		})
+		// Unblock the writer if the upload stops before reading everything.
+		pr.CloseWithError(err)
+		u.done <- err
+	}()
+	return u, nil
+}
+
+// Write sends p to the upload.
+func (u *s3Upload) Write(p []byte) (int, error) {
+	return u.pw.Write(p)
+}
+
+// finish completes the upload, or aborts it when err is not nil, and returns the first error.
+func (u *s3Upload) finish(err error) error {
+	if err != nil {
+		u.pw.CloseWithError(err)
+		<-u.done
+		return err
+	}
+	_ = u.pw.Close() // #nosec G104 -- closing a pipe writer never fails
+	return <-u.done
+}
+
+// contentType returns the media type of the output in the configured format.
+func (cfg *Config) contentType() string {
+	switch cfg.Format {
+	case formatJSON:
+		return "application/json"
+	case formatNDJSON:
+		return "application/x-ndjson"
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"criticalsys.net/hashcalcmt/pipeline"
+)
+
+// maxShardLen is the longest --shard-prefix-len, which opens up to 16^3 files at once.
+const maxShardLen = 3
+
+// shardSet splits the output into files of the --shard-output directory named by the first
+// hex digits of the first digest of each result, such as 00.txt to ff.txt, so that a large
+// manifest can be processed in parallel. Each shard is a complete manifest starting with the
+// header, and is replaced atomically when the set is closed.
+type shardSet struct {
+	dir    string
+	cfg    *Config
+	shards map[string]*shard
+	err    error
+}
+
+// shard is one output file of a shardSet.
+type shard struct {
+	file   *atomicFile
+	buf    *bufio.Writer
+	stream *resultStream
+}
+
+// newShardSet creates the --shard-output directory if needed. The shards are created as the
+// results routed to them arrive.
+func newShardSet(cfg *Config) (*shardSet, error) {
+	if err := os.MkdirAll(cfg.ShardDir, 0o750); err != nil {
+		return nil, err
+	}
+	return &shardSet{dir: cfg.ShardDir, cfg: cfg, shards: make(map[string]*shard)}, nil
+}
+
+// shardPrefix returns the prefix routing a result: the first --shard-prefix-len characters
+// of its digest of the first hash type, in lowercase so that --uppercase names the same files.
+func (cfg *Config) shardPrefix(result pipeline.Result) string {
+	digest := result.Hashes[cfg.HashTypes[0]]
+	if len(digest) > cfg.ShardLen {
+		digest = digest[:cfg.ShardLen]
+	}
+	return strings.ToLower(digest)
+}
+
+// open returns the shard of a prefix, creating its file and writing the header on first use.
+// It returns nil once creating a shard failed, the error being returned by close.
+func (s *shardSet) open(prefix string) *shard {
+	if sh, ok := s.shards[prefix]; ok {
+		return sh
+	}
+	if s.err != nil {
+		return nil
+	}
+	file, err := createAtomic(filepath.Join(s.dir, prefix+shardExt(s.cfg.Format)))
+	if err != nil {
+		s.err = err
+		return nil
+	}
+	buf := bufio.NewWriter(file)
+	sh := &shard{file: file, buf: buf, stream: &resultStream{w: buf, cfg: s.cfg}}
+	if s.cfg.header != nil && s.cfg.Format != formatJSON {
+		sh.stream.writeHeader(s.cfg.header)
+	}
+	s.shards[prefix] = sh
+	return sh
+}
+
+// writeResult writes a result to the shard of its prefix.
+func (s *shardSet) writeResult(result pipeline.Result) {
+	if sh := s.open(s.cfg.shardPrefix(result)); sh != nil {
+		sh.stream.writeResult(result)
+	}
+}
+
+// close flushes the shards and renames them over their destinations, or removes them all
+// when err or an error of any shard is not nil, leaving the shards of a previous run in place.
+// It returns the first error.
+func (s *shardSet) close(err error) error {
+	if err == nil {
+		err = s.err
+	}
+	prefixes := make([]string, 0, len(s.shards))
+	for prefix := range s.shards {
+		prefixes = append(prefixes, prefix)
+	}
+	slices.Sort(prefixes)
+	for _, prefix := range prefixes {
+		sh := s.shards[prefix]
+		if err == nil {
+			err = sh.stream.err
+		}
+		if err == nil {
+			err = sh.buf.Flush()
+		}
+	}
+	var errs []error
+	for _, prefix := range prefixes {
+		sh := s.shards[prefix]
+		if err != nil {
+			sh.file.Abort()
+		} else if commitErr := sh.file.Commit(); commitErr != nil {
+			errs = append(errs, commitErr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// writeJSONShards writes the results in the json format to the shards of their prefixes,
+// each holding its results sorted by path.
+func writeJSONShards(results map[string]pipeline.Result, cfg *Config) error {
+	shards, err := newShardSet(cfg)
+	if err != nil {
+		return err
+	}
+	groups := make(map[string]map[string]pipeline.Result)
+	for filePath, result := range results {
+		prefix := cfg.shardPrefix(result)
+		if groups[prefix] == nil {
+			groups[prefix] = make(map[string]pipeline.Result)
+		}
+		groups[prefix][filePath] = result
+	}
+	for prefix, group := range groups {
+		sh := shards.open(prefix)
+		if sh == nil {
+			break
+		}
+		if err = writeJSON(sh.buf, group, nil, cfg); err != nil {
+			break
+		}
+	}
+	return shards.close(err)
+}
+
+// shardExt returns the file extension of the shards of a format.
+func shardExt(format string) string {
+	switch format {
+	case formatJSON:
+		return ".json"
+	case formatNDJSON:
+		return ".ndjson"
+	default:
+		return ".txt"
+	}
+}
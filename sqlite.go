@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"time"
+
+	"criticalsys.net/hashcalcmt/pipeline"
+	_ "modernc.org/sqlite" // Registers the pure Go "sqlite" driver.
+)
+
+// sqliteSchema creates the tables of --sqlite when needed, keeping the rows of previous runs.
+// Every run adds a row to runs, and one row per file and hash type to hashes. The mtime is
+// an RFC 3339 UTC timestamp, or NULL when it is not known, such as for standard input.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id      INTEGER PRIMARY KEY,
+	started TEXT NOT NULL,
+	path    TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS hashes (
+	run_id    INTEGER NOT NULL REFERENCES runs(id),
+	path      TEXT NOT NULL,
+	algorithm TEXT NOT NULL,
+	hash      TEXT NOT NULL,
+	size      INTEGER NOT NULL,
+	mtime     TEXT
+);
+CREATE INDEX IF NOT EXISTS hashes_hash ON hashes(hash);
+CREATE INDEX IF NOT EXISTS hashes_path ON hashes(path);
+`
+
+// sqliteStore inserts the results of a run into a SQLite database. The rows are inserted
+// within a single transaction, committed by Close, so that a large run is not slowed down
+// by a disk sync per file. The first error is kept and stops further inserts.
+type sqliteStore struct {
+	db     *sql.DB
+	tx     *sql.Tx
+	insert *sql.Stmt
+	runID  int64
+	cfg    *Config
+	err    error
+}
+
+// openSQLite opens or creates the database, creates the schema if needed and records the run.
+func openSQLite(name string, cfg *Config, started time.Time) (store *sqliteStore, err error) {
+	db, err := sql.Open("sqlite", filepath.Clean(name))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = db.Close() // #nosec G104 -- the opening error is reported instead
+		}
+	}()
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		return nil, err
+	}
+
+	root := cfg.Path
+	if cfg.Stdin {
+		root = stdinPath
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec(`INSERT INTO runs (started, path) VALUES (?, ?)`, started.UTC().Format(time.RFC3339Nano), root)
+	if err != nil {
+		_ = tx.Rollback() // #nosec G104 -- the insert error is reported instead
+		return nil, err
+	}
+	runID, err := res.LastInsertId()
+	if err != nil {
+		_ = tx.Rollback() // #nosec G104 -- the insert error is reported instead
+		return nil, err
+	}
+	insert, err := tx.Prepare(`INSERT INTO hashes (run_id, path, algorithm, hash, size, mtime) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		_ = tx.Rollback() // #nosec G104 -- the prepare error is reported instead
+		return nil, err
+	}
+	return &sqliteStore{db: db, tx: tx, insert: insert, runID: runID, cfg: cfg}, nil
+}
+
+// add inserts one row per requested hash type of a result.
+func (s *sqliteStore) add(result pipeline.Result) {
+	var mtime sql.NullString
+	if !result.ModTime.IsZero() {
+		mtime = sql.NullString{String: result.ModTime.UTC().Format(time.RFC3339Nano), Valid: true}
+	}
+	for _, hashType := range s.cfg.HashTypes {
+		if s.err != nil {
+			return
+		}
+		_, s.err = s.insert.Exec(s.runID, filepath.ToSlash(result.FilePath), s.cfg.algorithm(hashType), result.Hashes[hashType], result.Size, mtime)
+	}
+}
+
+// Close commits the rows inserted so far, unless an insert failed, and closes the database.
+// The results of an interrupted run are committed like those of a complete one.
+func (s *sqliteStore) Close() error {
+	err := s.err
+	if err == nil {
+		err = s.tx.Commit()
+	} else {
+		_ = s.tx.Rollback() // #nosec G104 -- the insert error is reported instead
+	}
+	if closeErr := s.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
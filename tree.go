@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"criticalsys.net/hashcalcmt/hasher"
+	"criticalsys.net/hashcalcmt/pipeline"
+)
+
+// treeHash combines the digests of all files into a single digest representing the tree.
+// The canonical form hashed with the first requested hash type, keyed and encoded like the
+// file digests, is one "<path>\x00<digest>\n" line per file, where the path is relative to
+// --path with forward slashes and the lines are sorted by path in byte order.
+func treeHash(results map[string]pipeline.Result, cfg *Config) (string, error) {
+	hashType := cfg.HashTypes[0]
+	paths := make([]string, 0, len(results))
+	for filePath := range results {
+		paths = append(paths, filePath)
+	}
+	// Sorting the slash-separated form keeps the order identical on every platform.
+	for i, filePath := range paths {
+		paths[i] = filepath.ToSlash(filePath)
+	}
+	sort.Strings(paths)
+
+	var b strings.Builder
+	for _, name := range paths {
+		fmt.Fprintf(&b, "%s\x00%s\n", name, results[filepath.FromSlash(name)].Hashes[hashType])
+	}
+
+	hf, err := hasher.NewMultiHasher([]string{hashType}, cfg.hasherOptions(cfg.encoding))
+	if err != nil {
+		return "", err
+	}
+	hashes, err := hf(strings.NewReader(b.String()))
+	if err != nil {
+		return "", err
+	}
+	return hashes[hashType], nil
+}
+
+// writeTreeHash renders the tree digest to w, as a JSON record with the json and ndjson
+// formats, or otherwise alone on a line so it can be compared directly in scripts.
+func writeTreeHash(w io.Writer, digest string, cfg *Config) error {
+	if cfg.Format == formatJSON || cfg.Format == formatNDJSON {
+		enc := json.NewEncoder(w)
+		if cfg.Format == formatJSON {
+			enc.SetIndent("", "  ")
+		}
+		return enc.Encode(jsonRecord{Path: cfg.Path, Hash: digest, Algorithm: cfg.algorithm(cfg.HashTypes[0])})
+	}
+	_, err := fmt.Fprintln(w, digest)
+	return err
+}
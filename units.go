@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sizeUnits maps the accepted size suffixes to their multipliers.
+// Decimal (SI) and binary (IEC) suffixes are both accepted, case-insensitively.
+var sizeUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"K":   1 << 10,
+	"KB":  1000,
+	"KIB": 1 << 10,
+	"M":   1 << 20,
+	"MB":  1000 * 1000,
+	"MIB": 1 << 20,
+	"G":   1 << 30,
+	"GB":  1000 * 1000 * 1000,
+	"GIB": 1 << 30,
+	"T":   1 << 40,
+	"TB":  1000 * 1000 * 1000 * 1000,
+	"TIB": 1 << 40,
+}
+
+// parseSize parses a human-readable size such as "100MB", "2GiB" or "512" into bytes.
+// An empty value parses as 0.
+func parseSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	i := strings.IndexFunc(value, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(value)
+	}
+	number, unit := value[:i], strings.ToUpper(strings.TrimSpace(value[i:]))
+	multiplier, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q", value, value[i:])
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// parseRate parses a throughput such as "50MB/s" or "1GiB" into bytes per second.
+// The "/s" suffix is optional. An empty value parses as 0.
+func parseRate(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if trimmed, ok := strings.CutSuffix(strings.ToLower(value), "/s"); ok {
+		value = value[:len(trimmed)]
+	}
+	return parseSize(value)
+}
+
+// formatBytes renders a byte count with binary (IEC) units, e.g. "56.7 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// parseTimeBound parses an RFC3339 timestamp, or a duration relative to now such as "24h" or "7d".
+// An empty value parses as the zero time, meaning no bound.
+func parseTimeBound(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n < 0 {
+			return time.Time{}, fmt.Errorf("invalid time %q", value)
+		}
+		return now.Add(-time.Duration(n * float64(24*time.Hour))), nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("invalid time %q: expected an RFC3339 timestamp or a duration such as 24h or 7d", value)
+	}
+	return now.Add(-d), nil
+}
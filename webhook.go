@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"criticalsys.net/hashcalcmt/pipeline"
+)
+
+// webhookRetries is the number of times a failed --webhook request is retried, waiting one
+// second before the first retry and twice as long before each next one.
+const webhookRetries = 3
+
+// webhookPayload is the JSON body posted to --webhook: the metadata of the run, the sequence
+// number of the batch starting from 1, and the records of the results, as in the ndjson format.
+type webhookPayload struct {
+	Run     *manifestHeader `json:"run"`
+	Batch   int             `json:"batch"`
+	Results []jsonRecord    `json:"results"`
+}
+
+// webhookBatch is a batch queued for posting: its sequence number and its JSON body.
+type webhookBatch struct {
+	seq  int
+	body []byte
+}
+
+// webhookSender posts the results of a run to --webhook as they complete, in batches of
+// --webhook-batch records. The batches are queued and posted in order by a goroutine of their
+// own, so that a slow endpoint does not hold up the processing of the results. A request
+// failing with a network error or a 5xx status is retried; the first error that persists is
+// kept and stops further requests. Cancelling the context aborts the requests and the waits
+// between their retries.
+type webhookSender struct {
+	ctx     context.Context
+	url     string
+	client  *http.Client
+	size    int
+	cfg     *Config
+	run     *manifestHeader
+	batch   int
+	records []jsonRecord
+
+	mu      sync.Mutex
+	pending []webhookBatch
+	closed  bool
+	err     error
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+// newWebhook returns the sender of the results of a run started at the given time, and starts
+// its goroutine. The URL must be absolute, with the http or https scheme.
+func newWebhook(ctx context.Context, cfg *Config, started time.Time) (*webhookSender, error) {
+	u, err := url.Parse(cfg.Webhook)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid --webhook %q: expected an http or https URL", cfg.Webhook)
+	}
+	s := &webhookSender{
+		ctx:    ctx,
+		url:    u.String(),
+		client: &http.Client{Timeout: cfg.HookTimeout},
+		size:   cfg.HookBatch,
+		cfg:    cfg,
+		run:    newManifestHeader(cfg, started),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go s.loop()
+	return s, nil
+}
+
+// add queues one record per requested hash type of a result, posting the batch once full.
+func (s *webhookSender) add(result pipeline.Result) {
+	for _, hashType := range s.cfg.HashTypes {
+		s.queue(s.cfg.record(result, hashType))
+	}
+}
+
+// addError queues an error record when --json-errors is set, as for the ndjson format.
+func (s *webhookSender) addError(err error) {
+	if s.cfg.JSONErrors {
+		s.queue(errorRecord(err))
+	}
+}
+
+// queue adds a record to the current batch and queues it once full.
+func (s *webhookSender) queue(record jsonRecord) {
+	s.records = append(s.records, record)
+	if len(s.records) >= s.size {
+		s.flush()
+	}
+}
+
+// flush queues the current batch, if any, for the goroutine to post it. Nothing more is
+// queued once a batch failed.
+func (s *webhookSender) flush() {
+	if len(s.records) == 0 {
+		return
+	}
+	s.batch++
+	body, err := json.Marshal(webhookPayload{Run: s.run, Batch: s.batch, Results: s.records})
+	s.records = s.records[:0]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	if err != nil {
+		s.err = err
+		return
+	}
+	s.pending = append(s.pending, webhookBatch{seq: s.batch, body: body})
+	s.signal()
+}
+
+// signal wakes up the goroutine, without blocking when it is already due to wake up.
+func (s *webhookSender) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// loop posts the queued batches in order until the sender is closed and the queue is empty,
+// or a batch failed.
+func (s *webhookSender) loop() {
+	defer close(s.done)
+	for range s.wake {
+		for {
+			s.mu.Lock()
+			if s.err != nil || len(s.pending) == 0 {
+				closed := s.closed
+				s.mu.Unlock()
+				if closed {
+					return
+				}
+				break
+			}
+			batch := s.pending[0]
+			s.pending = s.pending[1:]
+			s.mu.Unlock()
+			if err := s.post(batch); err != nil {
+				s.mu.Lock()
+				s.err = err
+				s.mu.Unlock()
+			}
+		}
+	}
+}
+
+// post sends a batch, retrying the requests that fail with a network error or a 5xx status.
+// Other statuses are client errors that a retry would not fix.
+func (s *webhookSender) post(batch webhookBatch) error {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err := s.send(batch.body)
+		var statusErr *webhookStatusError
+		if err == nil || (errors.As(err, &statusErr) && statusErr.Code < http.StatusInternalServerError) || attempt == webhookRetries || s.ctx.Err() != nil {
+			return err
+		}
+		logger.Warn("retrying webhook request", "batch", batch.seq, "attempt", attempt+1, "error", err)
+		select {
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// webhookStatusError is a response to a --webhook request with a status other than 2xx.
+type webhookStatusError struct {
+	Code   int
+	Status string
+}
+
+// Error returns the status of the response.
+func (e *webhookStatusError) Error() string {
+	return "webhook returned " + e.Status
+}
+
+// send posts a batch once.
+func (s *webhookSender) send(body []byte) error {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }() // #nosec G104 -- the body is only drained
+	_, _ = io.Copy(io.Discard, resp.Body)    // #nosec G104 -- draining lets the connection be reused
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &webhookStatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	return nil
+}
+
+// Close queues the last batch, waits for the goroutine to post the queued batches and returns
+// the first error that persisted.
+func (s *webhookSender) Close() error {
+	s.flush()
+	s.mu.Lock()
+	s.closed = true
+	s.signal()
+	s.mu.Unlock()
+	<-s.done
+	return s.err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"criticalsys.net/hashcalcmt/pipeline"
+)
+
+// TestWebhookBatches checks that the results are posted in batches of --webhook-batch records,
+// numbered from 1 in order, the last one being posted by Close.
+func TestWebhookBatches(t *testing.T) {
+	var mu sync.Mutex
+	var sizes, seqs []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		seqs = append(seqs, payload.Batch)
+		sizes = append(sizes, len(payload.Results))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	cfg := &Config{Webhook: server.URL, HookBatch: 2, HookTimeout: time.Second, HashTypes: []string{"SHA256"}}
+	hook, err := newWebhook(context.Background(), cfg, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 5 {
+		hook.add(pipeline.Result{FilePath: "f" + strconv.Itoa(i), Hashes: map[string]string{"SHA256": "00"}})
+	}
+	if err := hook.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 2, 3}; !slices.Equal(seqs, want) {
+		t.Errorf("batches %v, want %v", seqs, want)
+	}
+	if want := []int{2, 2, 1}; !slices.Equal(sizes, want) {
+		t.Errorf("batch sizes %v, want %v", sizes, want)
+	}
+}
+
+// TestWebhookCancel checks that queueing results does not wait for a failing endpoint, and
+// that cancelling the context stops the retries without waiting for their delays.
+func TestWebhookCancel(t *testing.T) {
+	requests := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := &Config{Webhook: server.URL, HookBatch: 1, HookTimeout: time.Second, HashTypes: []string{"SHA256"}}
+	hook, err := newWebhook(ctx, cfg, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	begin := time.Now()
+	for i := range 3 {
+		hook.add(pipeline.Result{FilePath: "f" + strconv.Itoa(i), Hashes: map[string]string{"SHA256": "00"}})
+	}
+	<-requests
+	cancel()
+	if err := hook.Close(); err == nil {
+		t.Error("Close returned no error after a failed batch")
+	}
+	if elapsed := time.Since(begin); elapsed > 500*time.Millisecond {
+		t.Errorf("Close returned after %s, want the retry delays to be cancelled", elapsed)
+	}
+}